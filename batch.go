@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	batchDefault = 5    // Number of candidates of /gen without arguments and of the reply button
+	batchMax     = 10   // Maximal number of candidates in one message
+	exportMin    = 10   // Minimal number of exported passphrases
+	exportMax    = 1000 // Maximal number of exported passphrases
+
+	batchTextMax = 4000 // Telegram doesn't send messages longer than 4096 characters
+
+	batchButton = "Generate ×5"
+)
+
+var ErrNoCandidate = errors.New("There is no such candidate in the message")
+
+// generateBatch returns n passphrases generated with the config
+func generateBatch(gpc *GeneratePasswordConfig, n int) ([]string, error) {
+	passphrases := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		passphrase, err := gpc.Generate()
+		if err != nil {
+			return nil, err
+		}
+		passphrases = append(passphrases, passphrase)
+	}
+	return passphrases, nil
+}
+
+// batchMessage returns message with n candidates. Every candidate has
+// a button to keep it, the other candidates are removed after the click
+func batchMessage(ctx context.Context, st Storage, chatID int64, n int) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(chatID, "")
+
+	gpc := personGenerateConfig(ctx, st, chatID)
+	passphrases, err := generateBatch(gpc, n)
+	if errors.Is(err, ErrPolicyUnsatisfiable) {
+		msg.Text = err.Error() + ". Change the policy with /policy"
+		return
+	}
+	if err != nil {
+		logger.Error("Can't generate passphrases", zap.Error(err), zap.Int64("personid", chatID))
+		msg.Text = "Can't generate passphrases. Sorry."
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<b>Pick one of the passphrases</b>\n")
+	for i, p := range passphrases {
+		sb.WriteString(fmt.Sprintf("\n%d. <code>%s</code>", i+1, tgbotapi.EscapeText(tgbotapi.ModeHTML, p)))
+	}
+	sb.WriteString(fmt.Sprintf("\n\nEntropy of each: <b>%.1f bits</b>", gpc.Entropy()))
+
+	if utf8.RuneCountInString(sb.String()) > batchTextMax {
+		msg.Text = "Passphrases are too long to show several of them in one message. Try /gen with a smaller number or /export"
+		return
+	}
+
+	msg.Text = sb.String()
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = IKBBatch(len(passphrases), gpc.Entropy())
+	return
+}
+
+// handleGenCommand returns the message with candidates, /gen N returns N of them
+func handleGenCommand(ctx context.Context, st Storage, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	n := batchDefault
+	if arg := strings.TrimSpace(m.CommandArguments()); arg != "" {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil || n < 1 || n > batchMax {
+			return tgbotapi.NewMessage(m.Chat.ID, fmt.Sprintf("Type the number of passphrases from 1 to %d after the command, for example /gen 5", batchMax))
+		}
+	}
+
+	return batchMessage(ctx, st, m.Chat.ID, n)
+}
+
+// sendGenCommand sends the candidates of /gen itself, so they can be deleted after a while
+func sendGenCommand(ctx context.Context, st Storage, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	sendSelfDestructing(ctx, st, m.Chat.ID, handleGenCommand(ctx, st, m))
+	return
+}
+
+// keepCandidate leaves only the chosen candidate in the message
+func keepCandidate(cq *tgbotapi.CallbackQuery, arg string) error {
+	// Candidates are taken from the message, so the server doesn't keep them
+	candidates := messageCodes(cq.Message)
+	index, bitsArg, _ := strings.Cut(arg, ":")
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 || i >= len(candidates) {
+		return ErrNoCandidate
+	}
+	bits, _ := strconv.ParseFloat(bitsArg, 64)
+
+	ec := tgbotapi.NewEditMessageText(cq.Message.Chat.ID, cq.Message.MessageID, passphraseText(candidates[i], StrengthOf(bits)))
+	ec.ParseMode = tgbotapi.ModeHTML
+	ec.ReplyMarkup = inlPasswordOptions()
+	if _, err := bot.Request(ec); err != nil {
+		return err
+	}
+
+	callbackAnswer(cq.ID, fmt.Sprintf("Passphrase %d is kept", i+1))
+	return nil
+}
+
+// exportDocument returns file with the passphrases. CSV has columns
+// with the number, the passphrase and its entropy in bits
+func exportDocument(passphrases []string, bits float64, format string) (tgbotapi.FileBytes, error) {
+	var buf bytes.Buffer
+
+	switch format {
+	case "csv":
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"n", "passphrase", "entropy_bits"})
+		for i, p := range passphrases {
+			w.Write([]string{strconv.Itoa(i + 1), p, strconv.FormatFloat(bits, 'f', 1, 64)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return tgbotapi.FileBytes{}, err
+		}
+	default:
+		format = "txt"
+		for _, p := range passphrases {
+			buf.WriteString(p + "\n")
+		}
+	}
+
+	return tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("passphrases_%d.%s", len(passphrases), format),
+		Bytes: buf.Bytes(),
+	}, nil
+}
+
+// handleExportCommand sends the document with passphrases: /export N [txt|csv]
+func handleExportCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "")
+
+	usage := fmt.Sprintf("Type the number of passphrases from %d to %d and the format after the command, for example:\n<code>/export 100 csv</code>\nFormat is <code>txt</code> (one passphrase per line) or <code>csv</code>", exportMin, exportMax)
+	args := strings.Fields(m.CommandArguments())
+	if len(args) == 0 || len(args) > 2 {
+		msg.Text = usage
+		msg.ParseMode = tgbotapi.ModeHTML
+		return
+	}
+	n, err := strconv.Atoi(args[0])
+	format := "txt"
+	if len(args) == 2 {
+		format = strings.ToLower(args[1])
+	}
+	if err != nil || n < exportMin || n > exportMax || (format != "txt" && format != "csv") {
+		msg.Text = usage
+		msg.ParseMode = tgbotapi.ModeHTML
+		return
+	}
+
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		logger.Error("Can't get storage from context", zap.Error(ErrCantParseCtx))
+		msg.Text = "Error on the server side. Sorry."
+		return
+	}
+
+	gpc := personGenerateConfig(ctx, st, m.Chat.ID)
+	passphrases, err := generateBatch(gpc, n)
+	if errors.Is(err, ErrPolicyUnsatisfiable) {
+		msg.Text = err.Error() + ". Change the policy with /policy"
+		return
+	}
+	if err != nil {
+		logger.Error("Can't generate passphrases", zap.Error(err), zap.Int64("personid", m.Chat.ID))
+		msg.Text = "Can't generate passphrases. Sorry."
+		return
+	}
+
+	file, err := exportDocument(passphrases, gpc.Entropy(), format)
+	if err != nil {
+		logger.Error("Can't create export file", zap.Error(err))
+		msg.Text = "Can't create the file. Sorry."
+		return
+	}
+	doc := tgbotapi.NewDocument(m.Chat.ID, file)
+	if err := sendSelfDestructing(ctx, st, m.Chat.ID, doc); err != nil {
+		msg.Text = "Can't send the file. Sorry."
+		return
+	}
+
+	logger.Info("Exported passphrases", zap.Int64("personid", m.Chat.ID), zap.Int("count", n))
+	msg.Text = fmt.Sprintf("Here are %d passphrases with %.1f bits of entropy each. Delete the file from the chat when the accounts are set up.", n, gpc.Entropy())
+	return
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+	"golang.org/x/text/unicode/norm"
+)
+
+// bip39wl is the wordlist of BIP39 mnemonics. The order of words matters,
+// because index of the word is encoded in the mnemonic
+const bip39wl WL = "bip39_en"
+
+var (
+	ErrMnemonicLength   = errors.New("Mnemonic has to contain 12, 15, 18, 21 or 24 words")
+	ErrMnemonicChecksum = errors.New("Checksum of the mnemonic is wrong")
+	ErrNoBIP39Wordlist  = errors.New("BIP39 wordlist is not loaded")
+	ErrWordNotInList    = errors.New("Word is not in the BIP39 wordlist")
+)
+
+// mnemonicLengths are the allowed numbers of words of the mnemonic
+var mnemonicLengths = []int{12, 15, 18, 21, 24}
+
+// validMnemonicLength reports whether the mnemonic can have n words
+func validMnemonicLength(n int) bool {
+	for _, l := range mnemonicLengths {
+		if l == n {
+			return true
+		}
+	}
+	return false
+}
+
+// MnemonicEntropyBits returns size of the entropy of the mnemonic of n words.
+// Every word encodes 11 bits and one of 33 bits is the checksum
+func MnemonicEntropyBits(n int) int {
+	return n * 11 * 32 / 33
+}
+
+// MnemonicWordError points to the word of the mnemonic that is invalid
+type MnemonicWordError struct {
+	Index      int // Number of the word, starting from 1
+	Word       string
+	Suggestion string // Word from the list with the same first 4 letters, if there is one
+	Err        error
+}
+
+func (e MnemonicWordError) Error() string {
+	return fmt.Sprintf("word %d (%q): %s", e.Index, e.Word, e.Err)
+}
+
+func (e MnemonicWordError) Unwrap() error {
+	return e.Err
+}
+
+// bip39Words returns words of the BIP39 wordlist
+func bip39Words() ([]string, error) {
+	wl, ok := Wordlists[bip39wl]
+	if !ok || wl.Words() == nil || len(*wl.Words()) != 2048 {
+		return nil, ErrNoBIP39Wordlist
+	}
+	return *wl.Words(), nil
+}
+
+// NewMnemonic returns BIP39 mnemonic of n words made from fresh random entropy
+func NewMnemonic(n int) (string, error) {
+	if !validMnemonicLength(n) {
+		return "", ErrMnemonicLength
+	}
+	entropy := make([]byte, MnemonicEntropyBits(n)/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+	return mnemonicFromEntropy(entropy)
+}
+
+// mnemonicFromEntropy encodes the entropy of 16, 20, 24, 28 or 32 bytes as BIP39 mnemonic
+func mnemonicFromEntropy(entropy []byte) (string, error) {
+	n := len(entropy) * 3 / 4
+	if len(entropy)%4 != 0 || !validMnemonicLength(n) {
+		return "", ErrMnemonicLength
+	}
+	words, err := bip39Words()
+	if err != nil {
+		return "", err
+	}
+
+	// Entropy is followed by the first bits of its SHA-256 hash
+	// and the result is split into groups of 11 bits
+	sum := sha256.Sum256(entropy)
+	csBits := uint(n / 3)
+	b := new(big.Int).SetBytes(entropy)
+	b.Lsh(b, csBits)
+	b.Or(b, big.NewInt(int64(sum[0]>>(8-csBits))))
+
+	parts := make([]string, n)
+	mask := big.NewInt(2047)
+	for i := n - 1; i >= 0; i-- {
+		parts[i] = words[new(big.Int).And(b, mask).Int64()]
+		b.Rsh(b, 11)
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// ValidateMnemonic checks words and checksum of the BIP39 mnemonic.
+// Returned MnemonicWordError points to the invalid word
+func ValidateMnemonic(mnemonic string) error {
+	words, err := bip39Words()
+	if err != nil {
+		return err
+	}
+	index := make(map[string]int, len(words))
+	for i, w := range words {
+		index[w] = i
+	}
+
+	parts := strings.Fields(strings.ToLower(norm.NFKD.String(mnemonic)))
+	if !validMnemonicLength(len(parts)) {
+		return fmt.Errorf("%w, not %d", ErrMnemonicLength, len(parts))
+	}
+
+	b := new(big.Int)
+	for i, p := range parts {
+		n, ok := index[p]
+		if !ok {
+			return MnemonicWordError{Index: i + 1, Word: p, Suggestion: bip39Suggestion(words, p), Err: ErrWordNotInList}
+		}
+		b.Lsh(b, 11)
+		b.Or(b, big.NewInt(int64(n)))
+	}
+
+	csBits := uint(len(parts) / 3)
+	checksum := new(big.Int).And(b, big.NewInt(1<<csBits-1)).Int64()
+	b.Rsh(b, csBits)
+
+	entropy := make([]byte, MnemonicEntropyBits(len(parts))/8)
+	b.FillBytes(entropy)
+	sum := sha256.Sum256(entropy)
+	if int64(sum[0]>>(8-csBits)) != checksum {
+		// The last word contains the checksum, so it's the most probable mistake
+		last := len(parts)
+		return MnemonicWordError{Index: last, Word: parts[last-1], Err: ErrMnemonicChecksum}
+	}
+
+	return nil
+}
+
+// bip39Suggestion returns the word with the same first 4 letters.
+// Such words are unique in BIP39 wordlist
+func bip39Suggestion(words []string, word string) string {
+	if len(word) < 4 {
+		return ""
+	}
+	for _, w := range words {
+		if strings.HasPrefix(w, word[:4]) {
+			return w
+		}
+	}
+	return ""
+}
+
+// mnemonicValidationText returns the result of validation for the user
+func mnemonicValidationText(mnemonic string) string {
+	err := ValidateMnemonic(mnemonic)
+	if err == nil {
+		return "✅ Mnemonic is valid: every word is in the BIP39 wordlist and the checksum is correct."
+	}
+
+	var we MnemonicWordError
+	switch {
+	case errors.As(err, &we) && errors.Is(err, ErrWordNotInList):
+		text := fmt.Sprintf("❌ Word %d <b>%s</b> is not in the BIP39 wordlist.", we.Index, tgbotapi.EscapeText(tgbotapi.ModeHTML, we.Word))
+		if we.Suggestion != "" {
+			text += fmt.Sprintf(" Did you mean <b>%s</b>?", we.Suggestion)
+		}
+		return text
+	case errors.As(err, &we):
+		return fmt.Sprintf("❌ Checksum is wrong. Check word %d <b>%s</b>, it contains the checksum. Also check that the words are in the right order.", we.Index, tgbotapi.EscapeText(tgbotapi.ModeHTML, we.Word))
+	case errors.Is(err, ErrMnemonicLength):
+		return "❌ " + tgbotapi.EscapeText(tgbotapi.ModeHTML, err.Error())
+	}
+
+	logger.Error("Can't validate mnemonic", zap.Error(err))
+	return "Can't validate the mnemonic. Sorry."
+}
+
+// handleValidateCommand validates the mnemonic after the command
+// or asks the user to send it in the next message
+func handleValidateCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "")
+	msg.ParseMode = tgbotapi.ModeHTML
+
+	if mnemonic := m.CommandArguments(); mnemonic != "" {
+		// The mnemonic is a secret, so it doesn't stay in the chat
+		deleteMessage(m.Chat.ID, m.MessageID)
+		msg.Text = mnemonicValidationText(mnemonic)
+		return
+	}
+
+	if err := setLastAction(ctx, laValidateMnemonic); err != nil {
+		logger.Error("Can't set last action", zap.Error(err))
+		msg.Text = "Error on the server side. Sorry."
+		return
+	}
+	msg.Text = "Send me the BIP39 mnemonic to check its words and checksum. The message with the mnemonic will be deleted immediately."
+	msg.ReplyMarkup = IKBCancelAction
+	return
+}
+
+// mnemonicSettingsText returns text of /bip39 command
+func mnemonicSettingsText(n int) string {
+	text := "<b>BIP39 mnemonics</b>\n\nIn this mode every passphrase is a valid BIP39 mnemonic with the checksum, made from fresh random entropy. Separator, /transform and /policy are not applied, so wallets accept it.\n\n"
+	if n == 0 {
+		return text + "Mode is off."
+	}
+	return text + fmt.Sprintf("Mode is on: %d words, %d bits of entropy.", n, MnemonicEntropyBits(n))
+}
+
+// handleMnemonicCallback sets number of words of BIP39 mnemonics of the chat, 0 turns the mode off
+func handleMnemonicCallback(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		return ErrCantParseCtx
+	}
+
+	n := ParseInt(arg)
+	if n != 0 && !validMnemonicLength(n) {
+		return ErrMnemonicLength
+	}
+	chatID := cq.Message.Chat.ID
+	if !canChangeChatSettings(cq) {
+		callbackAnswer(cq.ID, ErrNotChatAdmin.Error())
+		return nil
+	}
+	if err := updateSettings(ctx, st, chatID, func(s *Settings) { s.Mnemonic = n }); err != nil {
+		return err
+	}
+
+	ec := tgbotapi.NewEditMessageTextAndMarkup(chatID, cq.Message.MessageID, mnemonicSettingsText(n), IKBMnemonic(n))
+	ec.ParseMode = tgbotapi.ModeHTML
+	if _, err := bot.Request(ec); err != nil {
+		return err
+	}
+
+	if n == 0 {
+		callbackAnswer(cq.ID, "BIP39 mode is off")
+	} else {
+		callbackAnswer(cq.ID, fmt.Sprintf("Mnemonics will have %d words", n))
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// loadBIP39Wordlist puts the embedded BIP39 wordlist into the registry
+func loadBIP39Wordlist(t *testing.T) {
+	t.Helper()
+	if _, ok := Wordlists[bip39wl]; ok {
+		return
+	}
+	fsys, err := fs.Sub(embeddedWordlists, "wordlists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl := &Wordlist{id: bip39wl, file: "bip39_dictionary.json", size: 2048}
+	if err := wl.Fill(fsys); err != nil {
+		t.Fatal(err)
+	}
+	Wordlists[bip39wl] = wl
+}
+
+// Official test vectors of BIP39 for the English wordlist
+var bip39Vectors = []struct {
+	entropy  string
+	mnemonic string
+}{
+	{
+		"00000000000000000000000000000000",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+	},
+	{
+		"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f",
+		"legal winner thank year wave sausage worth useful legal winner thank yellow",
+	},
+	{
+		"ffffffffffffffffffffffffffffffff",
+		"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo wrong",
+	},
+	{
+		"77c2b00716cec7213839159e404db50d",
+		"jelly better achieve collect unaware mountain thought cargo oxygen act hood bridge",
+	},
+	{
+		"808080808080808080808080808080808080808080808080",
+		"letter advice cage absurd amount doctor acoustic avoid letter advice cage absurd amount doctor acoustic avoid letter always",
+	},
+	{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon art",
+	},
+	{
+		"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+		"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo vote",
+	},
+	{
+		"3e141609b97933b66a060dcddc71fad1d91677db872031e85f4c015c5e7e8982",
+		"dignity pass list indicate nasty swamp pool script soccer toe leaf photo multiply desk host tomato cradle drill spread actor shine dismiss champion exotic",
+	},
+}
+
+func TestMnemonicFromEntropy(t *testing.T) {
+	loadBIP39Wordlist(t)
+	for _, v := range bip39Vectors {
+		entropy, err := hex.DecodeString(v.entropy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := mnemonicFromEntropy(entropy)
+		if err != nil {
+			t.Errorf("%s: %v", v.entropy, err)
+			continue
+		}
+		if got != v.mnemonic {
+			t.Errorf("%s: got %q, want %q", v.entropy, got, v.mnemonic)
+		}
+		if n := len(strings.Fields(got)); MnemonicEntropyBits(n) != len(entropy)*8 {
+			t.Errorf("%s: %d words encode %d bits, want %d", v.entropy, n, MnemonicEntropyBits(n), len(entropy)*8)
+		}
+	}
+}
+
+func TestValidateMnemonic(t *testing.T) {
+	loadBIP39Wordlist(t)
+	for _, v := range bip39Vectors {
+		if err := ValidateMnemonic(v.mnemonic); err != nil {
+			t.Errorf("%q: %v", v.mnemonic, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		mnemonic string
+		err      error
+		index    int // Number of the invalid word, 0 if there is none
+	}{
+		{
+			name:     "flipped last word of 12",
+			mnemonic: "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+			err:      ErrMnemonicChecksum,
+			index:    12,
+		},
+		{
+			name:     "flipped last word of 24",
+			mnemonic: "zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo",
+			err:      ErrMnemonicChecksum,
+			index:    24,
+		},
+		{
+			name:     "unknown word",
+			mnemonic: "legal winner thank year wave sausage worth useful legal winner thank yelow",
+			err:      ErrWordNotInList,
+			index:    12,
+		},
+		{
+			name:     "wrong length",
+			mnemonic: "zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo wrong",
+			err:      ErrMnemonicLength,
+		},
+		{
+			name:     "case and spaces",
+			mnemonic: "  Legal WINNER thank year wave sausage worth useful legal winner thank yellow ",
+		},
+	}
+	for _, tt := range tests {
+		err := ValidateMnemonic(tt.mnemonic)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		var we MnemonicWordError
+		if errors.As(err, &we) != (tt.index > 0) || we.Index != tt.index {
+			t.Errorf("%s: got word %d, want %d", tt.name, we.Index, tt.index)
+		}
+	}
+}
+
+func TestNewMnemonic(t *testing.T) {
+	loadBIP39Wordlist(t)
+	for _, n := range mnemonicLengths {
+		m, err := NewMnemonic(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(strings.Fields(m)); got != n {
+			t.Errorf("got %d words, want %d", got, n)
+		}
+		if err := ValidateMnemonic(m); err != nil {
+			t.Errorf("%q: %v", m, err)
+		}
+	}
+	if _, err := NewMnemonic(13); !errors.Is(err, ErrMnemonicLength) {
+		t.Errorf("got %v for 13 words", err)
+	}
+}
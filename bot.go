@@ -1,11 +1,218 @@
 package main
 
 import (
+	"fmt"
+
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
-// This variable changes in the generate.go file
-var IKBWordlistChooser tgbotapi.InlineKeyboardMarkup
+// IKBWordlistChooser returns keyboard on /list command.
+// Wordlist uploaded by the user is added next to the built-in ones if it's not nil
+func IKBWordlistChooser(custom *Wordlist) tgbotapi.InlineKeyboardMarkup {
+	var buttons []tgbotapi.InlineKeyboardButton
+	for _, id := range wlOrder {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(Wordlists[id].Name(), fmt.Sprintf("setwl$$%s", id)))
+	}
+	if custom != nil {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData("📄 "+custom.Name(), fmt.Sprintf("setwl$$%s", userwl)))
+	}
+	cancel := tgbotapi.NewInlineKeyboardButtonData("Cancel", "system$$cancel")
+
+	// Two buttons in a row
+	var ikb [][]tgbotapi.InlineKeyboardButton
+	for i := 0; i < len(buttons); i += 2 {
+		if i+1 < len(buttons) {
+			ikb = append(ikb, tgbotapi.NewInlineKeyboardRow(buttons[i], buttons[i+1]))
+			continue
+		}
+		// Place Cancel near the last element
+		ikb = append(ikb, tgbotapi.NewInlineKeyboardRow(buttons[i], cancel))
+	}
+	if len(buttons)%2 == 0 {
+		// Finish with a new row with one cancel button
+		ikb = append(ikb, tgbotapi.NewInlineKeyboardRow(cancel))
+	}
+
+	return tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: ikb,
+	}
+}
+
+// IKBTransforms returns keyboard of /transform command with the state of every option
+func IKBTransforms(t Transform) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, o := range transformOptions {
+		mark := "⬜"
+		if t.Has(o.t) {
+			mark = "✅"
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s %s", mark, o.name), fmt.Sprintf("trans$$%s", o.id)),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Close", "system$$cancel")))
+	return tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: rows,
+	}
+}
+
+// IKBPolicies returns keyboard of /policy command. The current policy is marked
+func IKBPolicies(builtin []Policy, own []Policy, current *Policy) tgbotapi.InlineKeyboardMarkup {
+	button := func(p Policy, prefix string) tgbotapi.InlineKeyboardButton {
+		text := prefix + p.Name
+		if current != nil && current.ID == p.ID {
+			text = "✅ " + text
+		}
+		return tgbotapi.NewInlineKeyboardButtonData(text, fmt.Sprintf("policy$$%s", p.ID))
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, p := range builtin {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(button(p, "")))
+	}
+	for _, p := range own {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(button(p, "📄 ")))
+	}
+
+	none := "No policy"
+	if current == nil {
+		none = "✅ " + none
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(none, fmt.Sprintf("policy$$%s", policyNone)),
+		tgbotapi.NewInlineKeyboardButtonData("Close", "system$$cancel"),
+	))
+	return tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: rows,
+	}
+}
+
+// IKBMnemonic returns keyboard of /bip39 command with the current number of words marked
+func IKBMnemonic(current int) tgbotapi.InlineKeyboardMarkup {
+	var buttons []tgbotapi.InlineKeyboardButton
+	for _, n := range mnemonicLengths {
+		text := fmt.Sprintf("%d words", n)
+		if n == current {
+			text = "✅ " + text
+		}
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(text, fmt.Sprintf("bip39$$%d", n)))
+	}
+
+	off := "Off"
+	if current == 0 {
+		off = "✅ " + off
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		buttons[:3],
+		append(buttons[3:], tgbotapi.NewInlineKeyboardButtonData(off, "bip39$$0")),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Close", "system$$cancel")),
+	)
+}
+
+// IKBSelfDestruct returns keyboard of /autodelete command with the current lifetime marked
+func IKBSelfDestruct(current int) tgbotapi.InlineKeyboardMarkup {
+	var buttons []tgbotapi.InlineKeyboardButton
+	for _, ttl := range selfDestructTTLs {
+		text := "Off"
+		if ttl != 0 {
+			text = fmt.Sprintf("%d min", ttl)
+		}
+		if ttl == current {
+			text = "✅ " + text
+		}
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(text, fmt.Sprintf("ttl$$%d", ttl)))
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(
+		buttons,
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Close", "system$$cancel")),
+	)
+}
+
+// IKBSettings returns keyboard of /settings command with the current separator marked
+func IKBSettings(sep string) tgbotapi.InlineKeyboardMarkup {
+	var seps []tgbotapi.InlineKeyboardButton
+	for i, p := range separatorPresets {
+		text := p.name
+		if p.sep == sep {
+			text = "✅ " + text
+		}
+		seps = append(seps, tgbotapi.NewInlineKeyboardButtonData(text, fmt.Sprintf("set$$sep:%d", i)))
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("➖ Word", "set$$dec"),
+			tgbotapi.NewInlineKeyboardButtonData("➕ Word", "set$$inc"),
+		),
+		seps,
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📚 Wordlist", "set$$wl"),
+			tgbotapi.NewInlineKeyboardButtonData("🔄 Reset", "set$$reset"),
+		),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Close", "system$$cancel")),
+	)
+}
+
+// IKBSettingsWordlists returns keyboard with wordlists shown in the message of /settings.
+// Wordlist uploaded by the user is added if it's not nil
+func IKBSettingsWordlists(current WL, custom *Wordlist) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	add := func(id WL, name string) {
+		if id == current {
+			name = "✅ " + name
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(name, fmt.Sprintf("set$$wl:%s", id))))
+	}
+	for _, id := range wlOrder {
+		add(id, Wordlists[id].Name())
+	}
+	if custom != nil {
+		add(userwl, "📄 "+custom.Name())
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("⬅️ Back", "set$$back")))
+	return tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: rows,
+	}
+}
+
+// IKBDiceWordlists returns keyboard of /dice command with wordlists made for dice
+func IKBDiceWordlists() tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, id := range wlOrder {
+		wl := Wordlists[id]
+		if wl.Dice() == 0 {
+			continue
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s (%d dice)", wl.Name(), wl.Dice()), fmt.Sprintf("dice$$%s", id)),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Cancel", "system$$cancel")))
+	return tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: rows,
+	}
+}
+
+// IKBBatch returns keyboard with a button to keep every of n candidates.
+// Entropy of the candidates is passed with the button, because settings
+// of the chat where they were generated may differ from the current chat
+func IKBBatch(n int, bits float64) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	var row []tgbotapi.InlineKeyboardButton
+	for i := 0; i < n; i++ {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Keep %d", i+1), fmt.Sprintf("keep$$%d:%.1f", i, bits)))
+		// Five buttons in a row
+		if len(row) == 5 || i == n-1 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🗑️ Delete", "delete")))
+	return tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: rows,
+	}
+}
 
 var IKBCancelAction = tgbotapi.NewInlineKeyboardMarkup(
 	tgbotapi.NewInlineKeyboardRow(
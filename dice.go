@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrNoRolls         = errors.New("There are no dice rolls")
+	ErrTooManyRolls    = errors.New("Too many dice rolls")
+	ErrNotDiceWordlist = errors.New("Wordlist is not made for dice")
+)
+
+// DiceRollError points to the roll that can't be mapped to a word
+type DiceRollError struct {
+	Index  int // Number of the roll, starting from 1
+	Roll   string
+	Reason string
+}
+
+func (e DiceRollError) Error() string {
+	return fmt.Sprintf("roll %d (%q) %s", e.Index, e.Roll, e.Reason)
+}
+
+// dicePow returns number of words in the list for n dice
+func dicePow(n int) int {
+	return int(math.Pow(6, float64(n)))
+}
+
+// DiceWords maps dice rolls like "41526 13355" to the words of the list.
+// Every roll is a word: digits of the dice from 1 to 6 are read
+// as a number in base 6, like in the printed EFF lists
+func DiceWords(wl *Wordlist, rolls string) ([]string, error) {
+	dice := wl.Dice()
+	if dice == 0 {
+		return nil, ErrNotDiceWordlist
+	}
+	words := *wl.Words()
+
+	fields := strings.FieldsFunc(rolls, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, ErrNoRolls
+	}
+	if len(fields) > maxlen {
+		return nil, ErrTooManyRolls
+	}
+
+	parts := make([]string, 0, len(fields))
+	for i, f := range fields {
+		if len(f) != dice {
+			return nil, DiceRollError{Index: i + 1, Roll: f, Reason: fmt.Sprintf("has to contain %d dice", dice)}
+		}
+		n := 0
+		for _, d := range f {
+			if d < '1' || d > '6' {
+				return nil, DiceRollError{Index: i + 1, Roll: f, Reason: "has to contain only digits from 1 to 6"}
+			}
+			n = n*6 + int(d-'1')
+		}
+		parts = append(parts, words[n])
+	}
+
+	return parts, nil
+}
+
+// handleDiceCommand asks the user to choose the wordlist for the dice
+func handleDiceCommand(personID int64) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(personID, "<b>Physical dice</b>\n\nRoll real dice and type the results, so the passphrase doesn't depend on the randomness of the server. Choose the wordlist:")
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = IKBDiceWordlists()
+	return
+}
+
+// handleDiceCallback remembers the chosen wordlist and asks for the rolls
+func handleDiceCallback(ctx context.Context, cq *tgbotapi.CallbackQuery, id string) error {
+	wl, ok := Wordlists[WL(id)]
+	if !ok || wl.Dice() == 0 {
+		return ErrNotDiceWordlist
+	}
+
+	if err := setLastAction(ctx, laDiceRolls); err != nil {
+		return err
+	}
+	if err := setLastActionArg(ctx, id); err != nil {
+		return err
+	}
+
+	msg := tgbotapi.NewMessage(cq.From.ID, fmt.Sprintf("Roll %d dice for every word and type the results separated by spaces, for example:\n<code>%s</code>\nRead the dice from left to right in the same order every time. The message with the rolls will be deleted immediately.", wl.Dice(), diceExample(wl.Dice())))
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = IKBCancelAction
+	deleteMessage(cq.Message.Chat.ID, cq.Message.MessageID)
+	botSend(msg)
+	callbackAnswer(cq.ID, fmt.Sprintf("%s is chosen", wl.Name()))
+	return nil
+}
+
+// diceExample returns example of rolls for n dice
+func diceExample(n int) string {
+	if n == 5 {
+		return "41526 13355 62114"
+	}
+	return strings.Repeat("1", n) + " " + strings.Repeat("6", n)
+}
+
+// handleDiceRolls maps the rolls of the person to the words.
+// Returned bool reports whether the last action is finished
+func handleDiceRolls(ctx context.Context, st Storage, personID int64, rolls string) (msg tgbotapi.MessageConfig, done bool, err error) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	id, err := st.LastActionArg(ctx, personID)
+	if err != nil {
+		msg.Text = "Choose the wordlist again with /dice"
+		return msg, true, err
+	}
+	wl, ok := Wordlists[WL(id)]
+	if !ok {
+		msg.Text = "Choose the wordlist again with /dice"
+		return msg, true, ErrNotDiceWordlist
+	}
+
+	parts, err := DiceWords(wl, rolls)
+	if err != nil {
+		var re DiceRollError
+		switch {
+		case errors.As(err, &re):
+			msg.Text = fmt.Sprintf("Roll %d <b>%s</b> %s. Try again.", re.Index, tgbotapi.EscapeText(tgbotapi.ModeHTML, re.Roll), re.Reason)
+		case errors.Is(err, ErrTooManyRolls):
+			msg.Text = fmt.Sprintf("Passphrase can't have more than %d words. Try again.", maxlen)
+		default:
+			msg.Text = "Type the rolls separated by spaces. Try again."
+		}
+		msg.ParseMode = tgbotapi.ModeHTML
+		msg.ReplyMarkup = IKBCancelAction
+		return msg, false, err
+	}
+
+	sep := defsep
+	if s, err := st.Settings(ctx, personID); err == nil {
+		sep = s.Separator
+	}
+
+	// Entropy is the same as for the server randomness if the dice are fair
+	gpc := NewGeneratePasswordConfig().Wordlist(wl.ID()).Length(len(parts))
+	msg.Text = passphraseText(strings.Join(parts, sep), gpc.Strength())
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = inlDicePassphraseOptions()
+	logger.Info("Mapped dice rolls of user", zap.Int64("personid", personID), zap.Int("words", len(parts)))
+	return msg, true, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadEmbeddedWordlist fills the list of the embedded manifest with the id
+func loadEmbeddedWordlist(t *testing.T, id WL) *Wordlist {
+	t.Helper()
+	fsys, err := fs.Sub(embeddedWordlists, "wordlists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readManifest(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.ID != id {
+			continue
+		}
+		wl := &Wordlist{id: e.ID, file: e.File, size: e.Size, dice: e.Dice}
+		if err := wl.Fill(fsys); err != nil {
+			t.Fatal(err)
+		}
+		return wl
+	}
+	t.Fatalf("%s is not in the manifest", id)
+	return nil
+}
+
+func TestDiceWords(t *testing.T) {
+	long := loadEmbeddedWordlist(t, "dice_long_en")
+	short := loadEmbeddedWordlist(t, "dice_short2_en")
+
+	// Words of the printed EFF lists
+	tests := []struct {
+		wl    *Wordlist
+		rolls string
+		want  []string
+	}{
+		{long, "11111", []string{"abacus"}},
+		{long, "66666", []string{"zoom"}},
+		{long, "41526 13355,25161", []string{"munchkin", "bazooka", "emboss"}},
+		{long, " 11111\n\t66666 ", []string{"abacus", "zoom"}},
+		{short, "1111", []string{"aardvark"}},
+		{short, "6666", []string{"zucchini"}},
+		{short, "2511 3425", []string{"embroidery", "hemoglobin"}},
+	}
+	for _, tt := range tests {
+		got, err := DiceWords(tt.wl, tt.rolls)
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.wl.ID(), tt.rolls, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %q: got %q, want %q", tt.wl.ID(), tt.rolls, got, tt.want)
+		}
+	}
+}
+
+func TestDiceWordsInvalid(t *testing.T) {
+	long := loadEmbeddedWordlist(t, "dice_long_en")
+	short := loadEmbeddedWordlist(t, "dice_short2_en")
+
+	tests := []struct {
+		name  string
+		wl    *Wordlist
+		rolls string
+		err   error
+		index int // Number of the invalid roll, 0 if it's not DiceRollError
+	}{
+		{"no rolls", long, " , ", ErrNoRolls, 0},
+		{"too many rolls", long, strings.Repeat("11111 ", maxlen+1), ErrTooManyRolls, 0},
+		{"not a dice list", loadEmbeddedWordlist(t, bip39wl), "11111", ErrNotDiceWordlist, 0},
+		{"4 dice for 5", long, "11111 1111", nil, 2},
+		{"5 dice for 4", short, "11111", nil, 1},
+		{"zero", long, "11011", nil, 1},
+		{"seven", short, "1117", nil, 1},
+		{"letter", long, "66666 1a111", nil, 2},
+	}
+	for _, tt := range tests {
+		words, err := DiceWords(tt.wl, tt.rolls)
+		if err == nil {
+			t.Errorf("%s: got %q", tt.name, words)
+			continue
+		}
+		var re DiceRollError
+		if tt.index > 0 {
+			if !errors.As(err, &re) || re.Index != tt.index {
+				t.Errorf("%s: got %v, want roll %d", tt.name, err, tt.index)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
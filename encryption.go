@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	encPassMinLen = 8  // Minimal length of the encryption password in bytes
+	encPassMaxLen = 64 // Maximal length of the encryption password in bytes
+
+	changeEncPassTTL = 5 * time.Minute // How long the old key waits for the new password
+
+	encPassAttempts = 10 // Number of times the vault is re-encrypted again if it's changed at the same time
+)
+
+var (
+	ErrEncPassTooShort     = errors.New("Password for encryption is too short")
+	ErrEncryptionDisabled  = errors.New("Encryption password is not set")
+	ErrNoPendingPassChange = errors.New("There is no password change in progress")
+	ErrVaultConflict       = errors.New("Vault is changed by somebody else during the password change")
+)
+
+// newVerifier returns salt followed by the Argon2id hash of the password.
+// The salt is different from the salt of the vault key, so the verifier
+// lets the server check the password, but it's useless for decryption
+func newVerifier(password string) ([]byte, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+	return append(salt, argon2.IDKey([]byte(password), salt, kdfTime, kdfMemory, kdfThreads, kdfKeyLen)...), nil
+}
+
+// checkVerifier reports whether the password matches the verifier
+func checkVerifier(verifier []byte, password string) bool {
+	if len(verifier) != kdfSaltLen+kdfKeyLen {
+		return false
+	}
+	salt, hash := verifier[:kdfSaltLen], verifier[kdfSaltLen:]
+	return subtle.ConstantTimeCompare(hash, argon2.IDKey([]byte(password), salt, kdfTime, kdfMemory, kdfThreads, kdfKeyLen)) == 1
+}
+
+// validEncPass checks length of the encryption password
+func validEncPass(password string) error {
+	if len(password) < encPassMinLen {
+		return ErrEncPassTooShort
+	}
+	if len(password) > encPassMaxLen {
+		return ErrEncPassTooLong
+	}
+	return nil
+}
+
+// pendingPassChanges keeps the old vault key of the person between the message
+// with the current password and the message with the new one
+var pendingPassChanges = newPendingStore[[]byte](changeEncPassTTL)
+
+// encryptionEnabled reports whether the person has set the encryption password
+func encryptionEnabled(conn RedisConn, personID int64) (bool, error) {
+	verifier, err := conn.NewRedisGetRequest().ID(personID).GetEncVerifier()
+	return len(verifier) > 0, err
+}
+
+// encryptionSettings returns text and keyboard of the /encryption message
+func encryptionSettings(conn RedisConn, personID int64) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	enabled, err := encryptionEnabled(conn, personID)
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, err
+	}
+
+	closeRow := tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Close", "system$$cancel"))
+	if !enabled {
+		text := "<b>Encryption is disabled</b>\n\nSet an encryption password to save passphrases in your vault. The password is never stored: only a salted hash to check it, so nobody can decrypt your vault without it. If you forget the password, saved passphrases can't be recovered."
+		return text, tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🔐 Set password", "enc$$set")),
+			closeRow,
+		), nil
+	}
+
+	text := "<b>Encryption is enabled</b>\n\nChanging the password re-encrypts every saved passphrase. Disabling encryption permanently deletes your vault."
+	return text, tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔑 Change password", "enc$$change"),
+			tgbotapi.NewInlineKeyboardButtonData("🔓 Disable", "enc$$disable"),
+		),
+		closeRow,
+	), nil
+}
+
+// handleEncryptionCallback handles clicks on the buttons of the /encryption message
+func handleEncryptionCallback(ctx context.Context, cq *tgbotapi.CallbackQuery, action string) error {
+	conn, ok := ctx.Value("redis-conn").(RedisConn)
+	if !ok {
+		return ErrCantParseCtx
+	}
+
+	enabled, err := encryptionEnabled(conn, cq.From.ID)
+	if err != nil {
+		return err
+	}
+
+	msg := tgbotapi.NewMessage(cq.From.ID, "")
+	msg.ReplyMarkup = IKBCancelAction
+	var la LastAction
+
+	switch action {
+	case "set":
+		if enabled {
+			callbackAnswer(cq.ID, "Encryption password is already set")
+			return nil
+		}
+		la = laSetEncPass
+		msg.Text = fmt.Sprintf("Send me the new encryption password. It has to be from %d to %d bytes long. The message with the password will be deleted immediately.", encPassMinLen, encPassMaxLen)
+	case "change":
+		if !enabled {
+			callbackAnswer(cq.ID, "Encryption password is not set")
+			return nil
+		}
+		la = laChangeEncPass
+		msg.Text = "Send me your current encryption password. The message with the password will be deleted immediately."
+	case "disable":
+		if !enabled {
+			callbackAnswer(cq.ID, "Encryption password is not set")
+			return nil
+		}
+		la = laDisableEncryption
+		msg.Text = "⚠️ Disabling encryption permanently deletes every passphrase saved in your vault.\nSend me your current encryption password to confirm. The message with the password will be deleted immediately."
+	default:
+		return nil
+	}
+
+	if err := setLastAction(ctx, la); err != nil {
+		return err
+	}
+	deleteMessage(cq.Message.Chat.ID, cq.Message.MessageID)
+	botSend(msg)
+	callbackAnswer(cq.ID, "Waiting for the encryption password")
+	return nil
+}
+
+// handleEncPassText handles messages with passwords sent during
+// setting, changing or disabling of the encryption.
+// Returned bool reports whether the last action is finished
+func handleEncPassText(conn RedisConn, personID int64, la LastAction, password string) (msg tgbotapi.MessageConfig, done bool, err error) {
+	msg = tgbotapi.NewMessage(personID, "")
+	rg := conn.NewRedisGetRequest().ID(personID)
+
+	switch la {
+	case laSetEncPass, laNewEncPass:
+		if err = validEncPass(password); err != nil {
+			msg.Text = fmt.Sprintf("Encryption password has to be from %d to %d bytes long. Try again.", encPassMinLen, encPassMaxLen)
+			msg.ReplyMarkup = IKBCancelAction
+			return msg, false, err
+		}
+
+		var oldKey []byte
+		if la == laNewEncPass {
+			var ok bool
+			if oldKey, ok = pendingPassChanges.Take(personID); !ok {
+				msg.Text = "Password change has expired. Start again with /encryption."
+				return msg, true, ErrNoPendingPassChange
+			}
+		} else if enabled, err := encryptionEnabled(conn, personID); err != nil || enabled {
+			msg.Text = "Encryption password is already set. Use /encryption to change it."
+			return msg, true, err
+		}
+
+		if err = setEncPass(conn, personID, oldKey, password); err != nil {
+			msg.Text = "Can't set the encryption password. Sorry."
+			return msg, true, err
+		}
+		// The key of the unlocked vault is not valid anymore
+		if err = lockVault(conn, personID); err != nil {
+			logger.Error("Can't lock the vault", zap.Error(err), zap.Int64("personid", personID))
+		}
+		msg.Text = "Encryption password successfully set! Don't forget it: saved passphrases can't be recovered without it."
+		logger.Info("Set encryption password of user", zap.Int64("personid", personID))
+		return msg, true, nil
+
+	case laChangeEncPass, laDisableEncryption:
+		verifier, err := rg.GetEncVerifier()
+		if err != nil || len(verifier) == 0 {
+			msg.Text = "Encryption password is not set."
+			return msg, true, ErrEncryptionDisabled
+		}
+		if !checkVerifier(verifier, password) {
+			msg.Text = "Wrong encryption password. Try again."
+			msg.ReplyMarkup = IKBCancelAction
+			return msg, false, ErrWrongEncPass
+		}
+
+		if la == laDisableEncryption {
+			endSession(personID)
+			if err := conn.NewRedisDelRequest().ID(personID).DeleteVault(); err != nil {
+				msg.Text = "Can't disable encryption. Sorry."
+				return msg, true, err
+			}
+			msg.Text = "Encryption is disabled and your vault is deleted."
+			logger.Info("Disabled encryption of user", zap.Int64("personid", personID))
+			return msg, true, nil
+		}
+
+		salt, err := rg.GetVaultSalt()
+		if err != nil {
+			msg.Text = "Error on the server side. Sorry."
+			return msg, true, err
+		}
+		pendingPassChanges.Put(personID, deriveKey(password, salt))
+		msg.Text = fmt.Sprintf("Now send me the new encryption password. It has to be from %d to %d bytes long.", encPassMinLen, encPassMaxLen)
+		msg.ReplyMarkup = IKBCancelAction
+		return msg, false, nil
+	}
+
+	return msg, true, nil
+}
+
+// setEncPass sets the new encryption password of the person.
+// If oldKey is not nil, every entry of the vault is re-encrypted with the new key.
+// Salt, verifier and entries are replaced in one transaction. The vault is watched,
+// so an entry saved during the re-encryption isn't lost, the vault is read again
+func setEncPass(conn RedisConn, personID int64, oldKey []byte, password string) error {
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	verifier, err := newVerifier(password)
+	if err != nil {
+		return err
+	}
+	key := deriveKey(password, salt)
+
+	for i := 0; i < encPassAttempts; i++ {
+		done, err := trySetEncPass(conn, personID, oldKey, salt, verifier, key)
+		if err != nil || done {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: person %d", ErrVaultConflict, personID)
+}
+
+// trySetEncPass runs one attempt of the password change.
+// false is returned if the vault was changed by somebody else
+func trySetEncPass(conn RedisConn, personID int64, oldKey, salt, verifier, key []byte) (bool, error) {
+	watched := []interface{}{
+		fmt.Sprintf("vault:%d", personID),
+		fmt.Sprintf("vsalt:%d", personID),
+		fmt.Sprintf("encver:%d", personID),
+	}
+	if _, err := conn.do("WATCH", watched...); err != nil {
+		return false, err
+	}
+	// Nothing is watched after EXEC, it's for the returns before it
+	defer conn.do("UNWATCH")
+
+	var entries []VaultEntry
+	if oldKey != nil {
+		var err error
+		entries, err = conn.NewRedisGetRequest().ID(personID).GetVaultEntries()
+		if err != nil {
+			return false, err
+		}
+		if err := reencryptEntries(entries, personID, oldKey, key); err != nil {
+			return false, err
+		}
+	}
+
+	err := conn.NewRedisSetRequest().ReplaceVault(personID, salt, verifier, entries)
+	if err == redis.ErrNil {
+		// EXEC is aborted, the vault is changed
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// reencryptEntries seals every entry of the person with the new key.
+// Entries are changed in place, nothing is changed if one of them can't be opened
+func reencryptEntries(entries []VaultEntry, personID int64, oldKey, newKey []byte) error {
+	items := make([]VaultItem, len(entries))
+	for i, e := range entries {
+		item, err := e.Open(oldKey, personID)
+		if err != nil {
+			return err
+		}
+		items[i] = item
+	}
+	for i := range entries {
+		if err := entries[i].Seal(newKey, personID, items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
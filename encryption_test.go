@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestVerifier(t *testing.T) {
+	verifier, err := newVerifier("correct password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifier) != kdfSaltLen+kdfKeyLen {
+		t.Fatalf("got %d bytes", len(verifier))
+	}
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"correct password", true},
+		{"Correct password", false},
+		{"correct password ", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := checkVerifier(verifier, tt.password); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.password, got, tt.want)
+		}
+	}
+
+	if checkVerifier(verifier[:kdfSaltLen], "correct password") {
+		t.Error("short verifier is accepted")
+	}
+}
+
+func TestReencryptEntries(t *testing.T) {
+	const personID = 42
+	oldKey, newKey := testKey(1), testKey(2)
+
+	entries := make([]VaultEntry, 5)
+	for i := range entries {
+		entries[i].ID = int64(i + 1)
+		if err := entries[i].Seal(oldKey, personID, VaultItem{Passphrase: fmt.Sprintf("pass %d", i+1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := reencryptEntries(entries, personID, oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("got %d entries", len(entries))
+	}
+	for _, e := range entries {
+		item, err := e.Open(newKey, personID)
+		if err != nil {
+			t.Errorf("entry %d: %v", e.ID, err)
+			continue
+		}
+		if want := fmt.Sprintf("pass %d", e.ID); item.Passphrase != want {
+			t.Errorf("entry %d: got %q, want %q", e.ID, item.Passphrase, want)
+		}
+		if _, err := e.Open(oldKey, personID); !errors.Is(err, ErrWrongEncPass) {
+			t.Errorf("entry %d is opened with the old key", e.ID)
+		}
+	}
+
+	// A wrong old key leaves the entries as they are
+	before := append([]VaultEntry(nil), entries...)
+	if err := reencryptEntries(entries, personID, oldKey, testKey(3)); !errors.Is(err, ErrWrongEncPass) {
+		t.Fatalf("got %v", err)
+	}
+	for i := range entries {
+		if string(entries[i].Sealed) != string(before[i].Sealed) {
+			t.Errorf("entry %d is changed", entries[i].ID)
+		}
+	}
+}
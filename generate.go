@@ -1,166 +1,66 @@
 package main
 
 import (
-	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"math/big"
+	"io"
+	"io/fs"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
-
-	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 type GeneratePasswordConfig struct {
 	length    int
 	separator string
 	wordlist  WL
+	custom    *Wordlist // Used instead of wordlist if it's not nil
+	target    float64   // Minimal entropy in bits. If it's positive, length is computed from it
+	transform Transform
+	policy    *Policy // Requirements of the site, none if it's nil
+	mnemonic  int     // Number of words of BIP39 mnemonic, the mode is off if it's 0
 }
 
-// Const number of one of several wordlists
-type WL int
-
-// bip39_en - English bip39 wordlist that is used as a human-readable private key for crypto wallet
-//
-// wordle_en - English list of 12000-ish number of 5-chars length words
-//
-// dice_long_en - List of words for use with five dice (6^5 = 7776 words)
-//
-// dice_short1_en - Featuring only short words, for use with four dice (6^4 = 1296 words)
-//
-// dice_short2_en - for use with four dice, featuring longer words that may be more memorable (6^4 = 1296 words)
-//
-// BIP39 wordlist - https://github.com/hatgit/BIP39-wordlist-printable-en/blob/master/BIP39-en-printable.txt
-//
-// All dice lists are here: https://www.eff.org/dice
-//
-// dice_long_en - https://www.eff.org/files/2016/07/18/eff_large_wordlist.txt
-//
-// dice_short1_en - https://www.eff.org/files/2016/09/08/eff_short_wordlist_1.txt
-//
-// dice_short2_en - https://www.eff.org/files/2016/09/08/eff_short_wordlist_2_0.txt
-const (
-	bip39_en WL = iota
-	wordle_en
-	dice_long_en
-	dice_short1_en
-	dice_short2_en
-	endofwl
-)
+// Maximal size of the downloaded wordlist in bytes, the biggest list is several times smaller
+const wordlistMaxSize = 1 << 20
+
+// ID of one of the wordlists from the registry (see registry.go)
+type WL string
+
+// userwl is the wordlist uploaded by the user with /addlist
+const userwl WL = "user"
 
 type Wordlist struct {
-	size        int
+	mu          sync.RWMutex // Guards size and words when the list is refreshed
+	id          WL
+	size        int // Expected number of words. Any if it's 0 before the list is filled
 	words       *[]string
-	uri         string
+	file        string // Name of the file in the wordlists directory
+	uri         string // Where the list can be downloaded
 	name        string
 	description string
+	language    string
+	source      string
+	example     string
+	dice        int // Number of dice for one word, 0 if the list is not made for dice
 }
 
 // A map with slices of words
 var Wordlists = make(map[WL]*Wordlist)
 
 func (wl WL) ShortName() string {
-	return fmt.Sprint(wlNames[wl])
-}
-
-// Names of each wordlist
-var wlNames = map[WL]string{
-	bip39_en:       `BIP39`,
-	wordle_en:      `Wordle`,
-	dice_long_en:   `Dice Long`,
-	dice_short1_en: `Dice Short 1`,
-	dice_short2_en: `Dice Short 2`,
-}
-
-// Length of each wordlist (used to save memory when allocating it for lists)
-var wlCapacities = map[WL]int{
-	bip39_en:       2048,
-	wordle_en:      12972,
-	dice_long_en:   7776,
-	dice_short1_en: 1296,
-	dice_short2_en: 1296,
-}
-
-// Links where you can download wordlists in JSON format
-var wlLink = map[WL]string{
-	bip39_en:       `https://raw.githubusercontent.com/bzhn/passph/master/wordlists/bip39_dictionary.json`,
-	wordle_en:      `https://raw.githubusercontent.com/bzhn/passph/master/wordlists/wordle-powerlanguage.json`,
-	dice_long_en:   `https://raw.githubusercontent.com/bzhn/passph/master/wordlists/eff_large_wordlist.json`,
-	dice_short1_en: `https://raw.githubusercontent.com/bzhn/passph/master/wordlists/eff_short_wordlist_1.json`,
-	dice_short2_en: `https://raw.githubusercontent.com/bzhn/passph/master/wordlists/eff_short_wordlist_2_0.json`,
-}
-
-func panicIfEmpty(wl []string) {
-	if len(wl) == 0 {
-		log.Panic("Fetched wordlist is empty")
-	}
-}
-
-func init() {
-	var err error
-	// Fill map with wordlists
-	for wl := WL(0); wl < endofwl; wl++ {
-		// wlSlice := make([]string, 0, wlCapacities[wl])
-		// wlSlice, err = getWordList(wlLink[wl])
-		Wordlists[wl] = &Wordlist{
-			size:        wlCapacities[wl],
-			uri:         wlLink[wl],
-			name:        wlNames[wl],
-			description: "",
-		}
-
-		Wordlists[wl].Fill()
-		errPanic(err)
-		// panicIfEmpty(wordlist[wl])
-		// wordlist[wl] = wlSlice
+	if l, ok := Wordlists[wl]; ok {
+		return l.Name()
 	}
-
-	// Keyboard on /list command
-	IKBWordlistChooser = func() tgbotapi.InlineKeyboardMarkup {
-		var ikb [][]tgbotapi.InlineKeyboardButton
-
-		// Loop through all wordlists and add them to keyboard
-		for n := WL(0); n < endofwl; n++ {
-			var ikbrow []tgbotapi.InlineKeyboardButton
-			ikbrow = append(ikbrow, tgbotapi.NewInlineKeyboardButtonData(Wordlists[n].Name(), fmt.Sprintf("setwl$$%d", n)))
-
-			// Finally, add the cancel button
-			if n+1 == endofwl {
-				if n%2 == 0 {
-					// Place Cancel near the last element
-					ikbrow = append(ikbrow, tgbotapi.NewInlineKeyboardButtonData("Cancel", "system$$cancel"))
-					ikb = append(ikb, ikbrow)
-				} else {
-					// Finish current row and create a new one with one cancel button
-					ikb = append(ikb, ikbrow)
-					ikb = append(ikb, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Cancel", "system$$cancel")))
-				}
-				continue
-			}
-
-			// Try to add one button next to first
-			if n+1 < endofwl {
-				n++
-				ikbrow = append(ikbrow, tgbotapi.NewInlineKeyboardButtonData(Wordlists[n].Name(), fmt.Sprintf("setwl$$%d", n)))
-			}
-
-			ikb = append(ikb, ikbrow)
-		}
-		return tgbotapi.InlineKeyboardMarkup{
-			InlineKeyboard: ikb,
-		}
-	}()
+	return string(wl)
 }
 
 func NewGeneratePasswordConfig() *GeneratePasswordConfig {
 	config := new(GeneratePasswordConfig)
 	config.length = 3
 	config.separator = " "
-	config.wordlist = bip39_en
+	config.wordlist = defwl
 	return config
 }
 
@@ -182,13 +82,80 @@ func (gpc *GeneratePasswordConfig) Wordlist(wl WL) *GeneratePasswordConfig {
 	return gpc
 }
 
+// Require at least bits of entropy instead of the fixed number of words.
+// Number of words is computed for the chosen wordlist, so the strength
+// stays the same when the wordlist is changed
+func (gpc *GeneratePasswordConfig) TargetEntropy(bits float64) *GeneratePasswordConfig {
+	gpc.target = bits
+	return gpc
+}
+
+// Apply transformations to the words of the future passphrase
+func (gpc *GeneratePasswordConfig) Transform(t Transform) *GeneratePasswordConfig {
+	gpc.transform = t
+	return gpc
+}
+
+// Shape the future passphrase with the policy of the site
+func (gpc *GeneratePasswordConfig) Policy(p *Policy) *GeneratePasswordConfig {
+	gpc.policy = p
+	return gpc
+}
+
+// Generate BIP39 mnemonics of n words instead of passphrases.
+// Other options don't apply to mnemonics. Mode is turned off if n is 0
+func (gpc *GeneratePasswordConfig) Mnemonic(n int) *GeneratePasswordConfig {
+	gpc.mnemonic = n
+	return gpc
+}
+
+// WordCount returns number of words in the future passphrase.
+// In the target entropy mode it's the minimal number of words
+// which gives the target. The result is limited by maxlen
+func (gpc *GeneratePasswordConfig) WordCount() int {
+	if gpc.mnemonic > 0 {
+		return gpc.mnemonic
+	}
+	if gpc.target <= 0 || !gpc.Valid() {
+		return gpc.length
+	}
+	gp, err := gpc.plan()
+	if err != nil {
+		return gpc.length
+	}
+	for n := 1; n < maxlen; n++ {
+		if gp.bits(n) >= gpc.target {
+			return n
+		}
+	}
+	return maxlen
+}
+
+// Use wordlist uploaded by the user instead of the built-in one
+func (gpc *GeneratePasswordConfig) UserWordlist(wl *Wordlist) *GeneratePasswordConfig {
+	gpc.custom = wl
+	if wl != nil {
+		gpc.wordlist = userwl
+	}
+	return gpc
+}
+
+// list returns the wordlist that will be used for generation
+func (gpc *GeneratePasswordConfig) list() *Wordlist {
+	if gpc.custom != nil {
+		return gpc.custom
+	}
+	return Wordlists[gpc.wordlist]
+}
+
 // Change wordlist of the future passphrase
 func (gpc *GeneratePasswordConfig) Valid() bool {
-	if _, ok := Wordlists[gpc.wordlist]; !ok {
+	wl := gpc.list()
+	if wl == nil || wl.Words() == nil {
 		return false
 	}
 
-	if len(*Wordlists[gpc.wordlist].words) == 0 {
+	if len(*wl.Words()) == 0 {
 		return false
 	}
 
@@ -197,26 +164,39 @@ func (gpc *GeneratePasswordConfig) Valid() bool {
 
 // Change wordlist of the future passphrase
 func (gpc *GeneratePasswordConfig) Generate() (string, error) {
+	if gpc.mnemonic > 0 {
+		return NewMnemonic(gpc.mnemonic)
+	}
 	if !gpc.Valid() {
 		return " ", errors.New("Generate password config is not valid")
 	}
 
-	var parts []string
-
-	for i := gpc.length; i > 0; i-- {
-		rnd, _ := rand.Int(rand.Reader, big.NewInt(int64(Wordlists[gpc.wordlist].Size())))
-		parts = append(parts, (*Wordlists[gpc.wordlist].words)[rnd.Int64()])
+	gp, err := gpc.plan()
+	if err != nil {
+		return " ", err
 	}
 
-	return strings.Join(parts, gpc.separator), nil
+	n := gpc.WordCount()
+	if gpc.target > 0 && gp.bits(n) < gpc.target {
+		return " ", fmt.Errorf("%w: %.0f bits can't be reached with this wordlist, lower the strength with /strength", ErrPolicyUnsatisfiable, gpc.target)
+	}
+	return gp.generate(n)
 }
 
 // Return size of the wordlist
 func (wl *Wordlist) Size() int {
+	wl.mu.RLock()
+	defer wl.mu.RUnlock()
 	return wl.size
 }
 
+func (wl *Wordlist) ID() WL {
+	return wl.id
+}
+
 func (wl *Wordlist) Words() *[]string {
+	wl.mu.RLock()
+	defer wl.mu.RUnlock()
 	return wl.words
 }
 
@@ -232,32 +212,88 @@ func (wl *Wordlist) Description() string {
 	return wl.description
 }
 
-// Download wordlist from the internet and insert words to the wordlist
-func (wl *Wordlist) Fill() error {
-	words := make([]string, 0, wl.size) // TODO: how to remove this assignment?
-	wl.words = &words
+func (wl *Wordlist) Language() string {
+	return wl.language
+}
+
+func (wl *Wordlist) Source() string {
+	return wl.source
+}
+
+func (wl *Wordlist) Example() string {
+	return wl.example
+}
+
+// Number of dice rolled for one word, 0 if the list is not made for physical dice
+func (wl *Wordlist) Dice() int {
+	return wl.dice
+}
 
+// Load wordlist from the wordlists directory and insert words to the wordlist
+func (wl *Wordlist) Fill(fsys fs.FS) error {
+	data, err := fs.ReadFile(fsys, wl.file)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrWordlistNotFound, wl.file)
+	}
+
+	return wl.replace(data)
+}
+
+// Download wordlist from the internet and replace words of the wordlist.
+// Words stay the same if the downloaded list is invalid
+func (wl *Wordlist) Refresh() error {
 	c := http.Client{
-		Timeout: 3 * time.Second,
+		Timeout: 10 * time.Second,
 	}
-	req, err := http.NewRequest(http.MethodGet, wl.uri, nil)
+	res, err := c.Get(wl.uri)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	res, err := c.Do(req)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status while downloading wordlist: %s", res.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, wordlistMaxSize))
 	if err != nil {
 		return err
 	}
-	if res.Body != nil {
-		defer res.Body.Close()
+
+	return wl.replace(body)
+}
+
+// replace parses JSON array of words, validates it and replaces words of the wordlist
+func (wl *Wordlist) replace(data []byte) error {
+	var words []string
+	if err := json.Unmarshal(data, &words); err != nil {
+		return fmt.Errorf("Can't parse wordlist %s: %w", wl.name, err)
+	}
+
+	if err := wl.validate(words); err != nil {
+		return err
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	wl.words = &words
+	wl.size = len(words)
+	return nil
+}
+
+// validate checks that the list has expected size,
+// doesn't have empty words, duplicates or too long words
+func (wl *Wordlist) validate(words []string) error {
+	if size := wl.Size(); size > 0 && len(words) != size {
+		return fmt.Errorf("Wordlist %s has %d words instead of %d", wl.name, len(words), size)
+	}
 
-	json.Unmarshal(body, wl.words)
+	valid, report, err := validateWordlist(words)
 	if err != nil {
-		return err
+		return fmt.Errorf("Wordlist %s is invalid: %w", wl.name, err)
+	}
+	if report.Empty > 0 || report.Duplicates > 0 || len(valid) != len(words) {
+		return fmt.Errorf("Wordlist %s has %d empty words and %d duplicates", wl.name, report.Empty, report.Duplicates)
 	}
 
 	return nil
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// wordlist1024 returns a list where every word adds 10 bits
+func wordlist1024() *Wordlist {
+	words := make([]string, 1024)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%04d", i)
+	}
+	return testWordlist(words...)
+}
+
+func TestWordCount(t *testing.T) {
+	wl := wordlist1024()
+	tests := []struct {
+		name      string
+		target    float64
+		transform Transform
+		mnemonic  int
+		want      int
+	}{
+		{name: "fixed length", want: 4},
+		{name: "exact target", target: 50, want: 5},
+		{name: "one bit more", target: 51, want: 6},
+		{name: "small target", target: 1, want: 1},
+		// 5 words give 50 bits and the digit adds log2(10*5) = 5.6
+		{name: "digit counts", target: 55, transform: TransDigit, want: 5},
+		{name: "title doesn't count", target: 55, transform: TransTitle, want: 6},
+		{name: "mnemonic", target: 50, mnemonic: 24, want: 24},
+	}
+	for _, tt := range tests {
+		gpc := NewGeneratePasswordConfig().
+			UserWordlist(wl).
+			Length(4).
+			TargetEntropy(tt.target).
+			Transform(tt.transform).
+			Mnemonic(tt.mnemonic)
+		if got := gpc.WordCount(); got != tt.want {
+			t.Errorf("%s: got %d words, want %d", tt.name, got, tt.want)
+		}
+		if tt.mnemonic == 0 && gpc.Entropy() < tt.target {
+			t.Errorf("%s: %v bits are below the target %v", tt.name, gpc.Entropy(), tt.target)
+		}
+	}
+}
+
+func TestTargetEntropyGenerate(t *testing.T) {
+	gpc := NewGeneratePasswordConfig().UserWordlist(wordlist1024()).Separator(" ").TargetEntropy(64)
+	passphrase, err := gpc.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(strings.Fields(passphrase)); n != 7 {
+		t.Errorf("%q has %d words, want 7", passphrase, n)
+	}
+
+	// 200 words of the list of 2 give only 200 bits
+	gpc = NewGeneratePasswordConfig().UserWordlist(testWordlist("a", "b")).TargetEntropy(500)
+	if n := gpc.WordCount(); n != maxlen {
+		t.Errorf("got %d words, want %d", n, maxlen)
+	}
+	if _, err := gpc.Generate(); !errors.Is(err, ErrPolicyUnsatisfiable) {
+		t.Errorf("got %v for unreachable target", err)
+	}
+}
@@ -8,9 +8,12 @@ require (
 	github.com/gomodule/redigo v1.8.9
 	github.com/joho/godotenv v1.4.0
 	go.uber.org/zap v1.23.0
+	golang.org/x/crypto v0.8.0
+	golang.org/x/text v0.13.0
 )
 
 require (
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
 )
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// Settings of generation (wordlist, number of words, separator and others)
+// are stored by ID of the chat. In private chats it's the ID of the person,
+// so every group gets its own settings. Vault, encryption, uploaded wordlists
+// and last actions always belong to the person (ID of the sender)
+
+var ErrNotChatAdmin = errors.New("Only administrators can change settings of the group")
+
+// isGroup reports whether the chat is a group or a supergroup
+func isGroup(chat *tgbotapi.Chat) bool {
+	return chat != nil && (chat.IsGroup() || chat.IsSuperGroup())
+}
+
+// isChatAdmin reports whether the person is an administrator of the chat
+func isChatAdmin(chatID, personID int64) (bool, error) {
+	member, err := bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chatID, UserID: personID},
+	})
+	if err != nil {
+		return false, err
+	}
+	return member.IsAdministrator() || member.IsCreator(), nil
+}
+
+// addressedToBot reports whether the command in the group is for this bot.
+// Commands like /gen@OtherBot are ignored
+func addressedToBot(m *tgbotapi.Message) bool {
+	cmd := m.CommandWithAt()
+	i := strings.Index(cmd, "@")
+	return i == -1 || strings.EqualFold(cmd[i+1:], bot.Self.UserName)
+}
+
+// groupHelpText returns text of /help in groups
+func groupHelpText() string {
+	return `<b>PassphraseBot in groups</b>
+
+/gen or /gen 3 generates passphrases with the settings of the group
+
+Administrators can set defaults of the group:
+/settings shows all settings of the group with buttons to change them
+/number 4 sets the number of words
+/sep - sets the separator (<code>\</code> is a space)
+/list chooses the wordlist
+/delivery on sends passphrases to the private chat with the bot instead of the group
+/autodelete deletes passphrases from the group after a few minutes
+
+Vault, encryption and other personal features are available in the private chat with the bot`
+}
+
+// handlePersonalCommand answers to commands that work only in private chats
+func handlePersonalCommand(ctx context.Context, m *tgbotapi.Message) tgbotapi.MessageConfig {
+	return tgbotapi.NewMessage(m.Chat.ID, fmt.Sprintf("This command works in the private chat with @%s", bot.Self.UserName))
+}
+
+// handleGroupHelpCommand returns /help of groups
+func handleGroupHelpCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, groupHelpText())
+	msg.ParseMode = tgbotapi.ModeHTML
+	return
+}
+
+// groupAdmin lets only administrators of the group run the command
+func groupAdmin(h CommandFunc) CommandFunc {
+	return func(ctx context.Context, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		admin, err := isChatAdmin(m.Chat.ID, m.From.ID)
+		if err != nil {
+			logger.Error("Can't get chat member", zap.Error(err), zap.Int64("chatid", m.Chat.ID))
+			return tgbotapi.NewMessage(m.Chat.ID, "Can't check your permissions. Sorry.")
+		}
+		if !admin {
+			return tgbotapi.NewMessage(m.Chat.ID, ErrNotChatAdmin.Error())
+		}
+		logger.Info("Changed settings of group", zap.Int64("chatid", m.Chat.ID), zap.String("command", m.Command()))
+		return h(ctx, m)
+	}
+}
+
+// handleGroupNumberCommand sets number of words of the group: /number 4
+func handleGroupNumberCommand(ctx context.Context, st Storage, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "")
+	n := ParseInt(strings.TrimSpace(m.CommandArguments()))
+	if n < 1 || n > maxlen {
+		msg.Text = fmt.Sprintf("Type the number of words from 1 to %d after the command, for example /number 4", maxlen)
+		return
+	}
+	err := updateSettings(ctx, st, m.Chat.ID, func(s *Settings) {
+		s.Words = n
+		s.TargetBits = 0
+	})
+	if err != nil {
+		logger.Error("Can't set number of words", zap.Error(err), zap.Int64("chatid", m.Chat.ID))
+		msg.Text = "Can't set number of words"
+		return
+	}
+	msg.Text = fmt.Sprintf("Passphrases of the group will have %d words", n)
+	return
+}
+
+// handleGroupSepCommand sets separator of the group: /sep -
+func handleGroupSepCommand(ctx context.Context, st Storage, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "")
+	arg := strings.TrimSpace(m.CommandArguments())
+	if arg == "" {
+		msg.Text = "Type the separator after the command, for example <code>/sep -</code>. For space, type <code>/sep \\</code>"
+		msg.ParseMode = tgbotapi.ModeHTML
+		return
+	}
+	sep, err := parseSeparator(arg)
+	if err != nil {
+		msg.Text = "Separator have to be less than 8 bytes long"
+		return
+	}
+	if err := updateSettings(ctx, st, m.Chat.ID, func(s *Settings) { s.Separator = sep }); err != nil {
+		logger.Error("Can't set separator", zap.Error(err), zap.Int64("chatid", m.Chat.ID))
+		msg.Text = "Error on the server side. Sorry."
+		return
+	}
+	msg.Text = "Separator of the group successfully changed"
+	return
+}
+
+// handleGroupListCommand shows wordlists of the group.
+// Wordlists uploaded by people are personal, so only built-in ones are offered
+func handleGroupListCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, wordlistsDescription())
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = IKBWordlistChooser(nil)
+	return
+}
+
+// handleGroupDeliveryCommand chooses where passphrases of the group are sent: /delivery on|off
+func handleGroupDeliveryCommand(ctx context.Context, st Storage, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "")
+	var private bool
+	switch strings.TrimSpace(m.CommandArguments()) {
+	case "on":
+		private = true
+	case "off":
+	default:
+		msg.Text = "Type /delivery on to send passphrases to the private chat with the bot, or /delivery off to send them to the group"
+		return
+	}
+	if err := updateSettings(ctx, st, m.Chat.ID, func(s *Settings) { s.PrivateDelivery = private }); err != nil {
+		logger.Error("Can't set delivery", zap.Error(err), zap.Int64("chatid", m.Chat.ID))
+		msg.Text = "Error on the server side. Sorry."
+		return
+	}
+	if private {
+		msg.Text = fmt.Sprintf("Passphrases will be sent to the private chat. Everyone has to start @%s first", bot.Self.UserName)
+	} else {
+		msg.Text = "Passphrases will be sent to the group"
+	}
+	return
+}
+
+// groupGenerate generates passphrases with the settings of the group and
+// sends them to the group or to the private chat with the sender
+func groupGenerate(ctx context.Context, st Storage, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = handleGenCommand(ctx, st, m)
+
+	s, err := st.Settings(ctx, m.Chat.ID)
+	if err != nil {
+		logger.Warn("Can't get delivery of group", zap.Error(err), zap.Int64("chatid", m.Chat.ID))
+	}
+	if !s.PrivateDelivery {
+		msg.ReplyToMessageID = m.MessageID
+		sendSelfDestructing(ctx, st, m.Chat.ID, msg)
+		return tgbotapi.MessageConfig{}
+	}
+
+	msg.ChatID = m.From.ID
+	reply := tgbotapi.NewMessage(m.Chat.ID, "")
+	reply.ReplyToMessageID = m.MessageID
+	// Lifetime of messages in the private chat is chosen by the person
+	if err := sendSelfDestructing(ctx, st, m.From.ID, msg); err != nil {
+		// The bot can't write first to people who haven't started it
+		reply.Text = fmt.Sprintf("Can't send you a message. Start @%s in the private chat and try again", bot.Self.UserName)
+		return reply
+	}
+	reply.Text = "Sent to your private chat with the bot"
+	return reply
+}
+
+// canChangeChatSettings reports whether the person who clicked the button
+// can change settings of the chat with the message
+func canChangeChatSettings(cq *tgbotapi.CallbackQuery) bool {
+	if cq.Message == nil || !isGroup(cq.Message.Chat) {
+		return true
+	}
+	admin, err := isChatAdmin(cq.Message.Chat.ID, cq.From.ID)
+	if err != nil {
+		logger.Error("Can't get chat member", zap.Error(err), zap.Int64("chatid", cq.Message.Chat.ID))
+		return false
+	}
+	return admin
+}
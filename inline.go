@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	inlineResults  = 5  // Number of passphrases in the answer to the inline query
+	inlineMaxWords = 20 // Maximal number of words that can be typed in the inline query
+)
+
+// handleInlineQuery answers with freshly generated passphrases built with
+// the settings of the person. The query can contain number of words
+func handleInlineQuery(ctx context.Context, iq *tgbotapi.InlineQuery) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		return ErrCantParseCtx
+	}
+
+	gpc := personGenerateConfig(ctx, st, iq.From.ID)
+	if n, err := strconv.Atoi(strings.TrimSpace(iq.Query)); err == nil && n > 0 && n <= inlineMaxWords {
+		gpc.Mnemonic(0).TargetEntropy(0).Length(n)
+	}
+
+	passphrases, err := generateBatch(gpc, inlineResults)
+	if err != nil {
+		return err
+	}
+
+	description := fmt.Sprintf("%.1f bits of entropy. Type a number to change the number of words", gpc.Entropy())
+	results := make([]interface{}, 0, len(passphrases))
+	for i, p := range passphrases {
+		r := tgbotapi.NewInlineQueryResultArticleHTML(strconv.Itoa(i), p, fmt.Sprintf("<code>%s</code>", tgbotapi.EscapeText(tgbotapi.ModeHTML, p)))
+		r.Description = description
+		results = append(results, r)
+	}
+
+	// InlineConfig omits zero cache time and Telegram caches results
+	// for 5 minutes by default, so the parameters are set manually.
+	// Results are personal and uncached, so nobody gets passphrases of others
+	params := make(tgbotapi.Params)
+	params["inline_query_id"] = iq.ID
+	params["cache_time"] = "0"
+	params.AddBool("is_personal", true)
+	if err := params.AddInterface("results", results); err != nil {
+		return err
+	}
+
+	_, err = bot.MakeRequest("answerInlineQuery", params)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Answered inline query", zap.Int64("personid", iq.From.ID))
+	return nil
+}
@@ -5,13 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
-	"time"
+	"syscall"
 
 	"github.com/bzhn/strkit"
 	"github.com/gomodule/redigo/redis"
@@ -27,12 +25,28 @@ type LastAction string
 var logger *zap.Logger
 
 const (
-	laSetSeparator LastAction = "setseparator"
-	laSetNubmer    LastAction = "setnumberofwords"
-	laSetEncPass   LastAction = "setencryptionpass"
+	laSetSeparator      LastAction = "setseparator"
+	laSetNubmer         LastAction = "setnumberofwords"
+	laSetEncPass        LastAction = "setencryptionpass"
+	laChangeEncPass     LastAction = "changeencryptionpass"
+	laNewEncPass        LastAction = "newencryptionpass"
+	laDisableEncryption LastAction = "disableencryption"
+	laVaultSave         LastAction = "vaultsave"
+	laVaultReveal       LastAction = "vaultreveal"
+	laVaultNote         LastAction = "vaultnote"
+	laVaultSearch       LastAction = "vaultsearch"
+	laVaultUnlock       LastAction = "vaultunlock"
+	laAddList           LastAction = "addlist"
+	laSetStrength       LastAction = "setstrength"
+	laValidateMnemonic  LastAction = "validatemnemonic"
+	laDiceRolls         LastAction = "dicerolls"
 
 	defsep = "-" // Default separator
 	deflen = 3   // Default length of passphrase
+	maxlen = 200 // Maximal length of passphrase
+
+	minbits = 16  // Minimal target entropy in bits
+	maxbits = 512 // Maximal target entropy in bits
 )
 
 var (
@@ -48,6 +62,7 @@ var (
 	ErrSeparatorTooLong          = errors.New("Separator is too long")
 	ErrNumberOfWordsTooBig       = errors.New("Number of words is too big")
 	ErrNumberOfWordsLessThanZero = errors.New("Number of words is less than zero")
+	ErrTargetEntropyOutOfRange   = errors.New("Target entropy is out of range")
 	ErrEncPassTooLong            = errors.New("Password for encryption is too long")
 )
 
@@ -55,14 +70,6 @@ func init() {
 	// Initialise logger
 	logger = NewLogger()
 
-	var err error
-
-	// Use telegram bot
-	godotenv.Load()
-	bot, err = tgbotapi.NewBotAPI(os.Getenv("PASSPHRASEBOT_TOKEN"))
-	errPanic(err)
-	logger.Info("Connected to Telegram Bot API", zap.String("username", bot.Self.UserName))
-
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
@@ -76,97 +83,51 @@ func ToJson(data interface{}) string {
 }
 
 func main() {
+	// Wordlists and the bot are set up here and not in init, so tests don't need them
+	loadWordlists()
 
-	pool := NewRedisPool("redis:6379")
-	conn := NewConn(pool)
-	defer conn.Close()
-	mainCtx := context.WithValue(context.Background(), "redis-conn", conn)
-	logger.Info("Created a new redis connection")
-
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates := bot.GetUpdatesChan(u)
-
-	// check for new messages in a loop
-	for upd := range updates {
-
-		if upd.CallbackQuery != nil {
-			updCtx := context.WithValue(mainCtx, "person", upd.CallbackQuery.From.ID)
-			handleInlineButtonClick(updCtx, upd.CallbackQuery)
-			continue
-		}
-
-		if upd.FromChat() == nil || upd.FromChat().Type != "private" {
-			log.Printf("The message is not private:\n%s", ToJson(upd.FromChat()))
-			continue
-		}
+	var err error
 
-		if upd.Message.Text == "" {
-			log.Printf("Got non-text message from chat")
-			continue
-		}
+	// Use telegram bot
+	godotenv.Load()
+	bot, err = tgbotapi.NewBotAPI(os.Getenv("PASSPHRASEBOT_TOKEN"))
+	errPanic(err)
+	logger.Info("Connected to Telegram Bot API", zap.String("username", bot.Self.UserName))
 
-		// msg is a message to be sent
-		var msg tgbotapi.MessageConfig
-		m := upd.Message
-		msg.ChatID = m.Chat.ID
-		if m.Text == "" {
-			msg = handleUnknowMessage(m)
-			botSend(msg)
-			continue
-		}
-		if m.Text == "Generate" || m.Text == "gen" || m.Text == "generate" {
-			deleteMessage(m.Chat.ID, m.MessageID)
-			generatePassphrase(mainCtx, m.Chat.ID)
-			continue
-		}
-		if m.IsCommand() {
-			updCtx := context.WithValue(mainCtx, "person", m.Chat.ID)
-			msg = handleCommand(updCtx, m)
-			botSend(msg)
-			continue
-		}
-		if m.Text != "" {
-			updCtx := context.WithValue(mainCtx, "person", m.Chat.ID)
-			updCtx = context.WithValue(updCtx, "msg", m.Text)
-			err := handleLastActionText(updCtx)
-			if err != nil {
-				log.Println("Can't handle last action", err)
-			}
-		}
+	// The pool is nil if the bot runs without Redis
+	pool, newStorage, err := storageFromEnv()
+	if err != nil {
+		logger.Fatal("Can't open storage", zap.Error(err))
 	}
-}
-
-// getWordList gets list of words from the providen url
-// and returns the slice of string with words
-// Error will be returned if the link is invalid, or if
-// it's impossible to parse list in the url
-func getWordList(url string) (words []string, err error) {
-	c := http.Client{
-		Timeout: 3 * time.Second,
+	if pool != nil {
+		defer pool.Close()
 	}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return
-	}
+	startWordlistRefresh()
+	startSelfDestruct(pool, newStorage)
 
-	res, err := c.Do(req)
-	if err != nil {
-		return
-	}
-	if res.Body != nil {
-		defer res.Body.Close()
+	router := newRouter()
+	if err := router.PublishCommands(); err != nil {
+		logger.Warn("Can't publish commands", zap.Error(err))
 	}
+	workers := startWorkers(workersCount(), pool, newStorage, router)
 
-	body, err := ioutil.ReadAll(res.Body)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	json.Unmarshal(body, &words)
-	if err != nil {
-		return
+	// Updates come from the webhook or from long polling, both go to the workers
+	if cfg, ok := webhookConfigFromEnv(); ok {
+		if err := runWebhook(cfg, workers, stop); err != nil {
+			logger.Error("Webhook server stopped", zap.Error(err))
+		}
+	} else {
+		runPolling(workers, stop)
 	}
 
-	return
+	logger.Info("Shutting down")
+	if !workers.Stop(shutdownTimeout) {
+		logger.Warn("Workers didn't finish in time", zap.Duration("timeout", shutdownTimeout))
+	}
 }
 
 // errPanic receive error and if it's not nil, make panic
@@ -178,93 +139,184 @@ func errPanic(err error) {
 }
 
 // botSend receive MessageConfig and tries to send it
-// If there is an error
+// If there is an error. Message without text is already sent by the handler
 func botSend(msg tgbotapi.MessageConfig) {
+	if msg.Text == "" {
+		return
+	}
 	_, err := bot.Send(msg)
 	if err != nil {
 		logger.Error("Can't send message to user", zap.Error(err), zap.Int64("personid", msg.ChatID))
 	}
 }
 
-// handleCommand handles commands from users
-// and returns a message that has to be sent
-func handleCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
-	logger.Info("Got command from user", zap.String("command", m.Command()))
-	msg.ChatID = m.Chat.ID
-	switch m.Command() {
-	case "start":
-		msg.ReplyMarkup = genButton()
-		msg.Text = "Hello. Use this bot to generate strong mnemonic passwords which, however, easy to memorise!\nClick Generate button at the bottom of the chat or type \"gen\""
-		return
+// helpText is the text of /help, %s is the username of the bot
+const helpText = ` This bot allows you to create mnemonic passwords by single click
 
-	case "help":
-		msg.ReplyMarkup = genButton()
-		msg.Text = ` This bot allows you to create mnemonic passwords by single click
+Type /settings to see all your settings and change them with buttons
 
 You can setup number of words in generated passphrases with /number
 
+Or set the target strength in bits with /strength, and the number of words will be chosen for any wordlist
+
 In order to change default separator between words, type /sep
+
+Add capital letters, a digit or a symbol to passphrases with /transform
+
+If a site has password rules, choose or define them with /policy
+
+Generate valid BIP39 mnemonics for crypto wallets with /bip39 and check a mnemonic with /validate
+
+Don't trust the randomness of the server? Roll real dice and type the results after /dice
+
+Type /gen 5 to choose one of several passphrases, or /export 100 csv to get a file with many of them
+
+In any chat, type @%s to pick a passphrase made with your settings
 		
-You can even change the list of words that will be used for generation. Type /list to try!`
-		msg.ParseMode = tgbotapi.ModeHTML
-		return
+You can even change the list of words that will be used for generation. Type /list to try! Upload your own list with /addlist
 
-	case "number": // set number of words in generated passphrases
-		setLastAction(ctx, laSetNubmer)
-		msg.Text = "Choose number of words in the passphrases that will be generated. The value have to contain only numbers and nothing more."
-		msg.ReplyMarkup = IKBCancelAction
-	case "sep": // set separator in generated passphrases
-		setLastAction(ctx, laSetSeparator)
-		msg.Text = "Type separator of the passphrases that will be generated. It can be <code>-</code> or <code>_</code> or even newline, for instance. Separator has to be less than 10 bytes long.\nTo set space as a separator, type <code>\\</code> (just backslash). For newline, type <code>\\n</code>. Note that first backslash will be removed from any of your messages (if you use it), so for one backslash as a separator you have to specify two backslashes."
-		msg.ParseMode = tgbotapi.ModeHTML
-		msg.ReplyMarkup = IKBCancelAction
+Click "💾 Save" under a passphrase to encrypt and store it. Type /vault to see your saved passphrases
 
-	case "list":
-		msg.ReplyMarkup = IKBWordlistChooser
-		msg.Text = `<b>Select desired wordlist</b>
+Set or change the password that encrypts your vault with /encryption
 
-Here are some examples of generated passphrases:
-BIP39
-<code>spider music exhibit</code>
+Click "🖊️ Save with note" to save a passphrase with a note and find it later with /search
 
-<b>Wordle</b>
-(only 5-chars words, 12000ish words in the list)
-<code>spews livid airns</code>
+Type /unlock to use the vault without the encryption password for a while and /lock to lock it again
 
-<b>Dice Long</b>
-(6^5 = 7776 words)
-<code>freebee attendant empirical</code>
+Type /autodelete to delete messages with passphrases automatically after a few minutes`
 
-<b>Dice Short 1</b>
-Featuring only short words (6^4 = 1296 words)
-<code>stack lip visa</code>
+// handleStartCommand greets the person and shows the Generate button
+func handleStartCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "Hello. Use this bot to generate strong mnemonic passwords which, however, easy to memorise!\nClick Generate button at the bottom of the chat or type \"gen\"")
+	msg.ReplyMarkup = genButton()
+	return
+}
 
-<b>Dice Short 2</b>
-Featuring longer words that may be more memorable (6^4 = 1296 words)
-<code>liquid mapmaker shyness</code>
-`
-		msg.ParseMode = tgbotapi.ModeHTML
+// handleHelpCommand returns text of /help
+func handleHelpCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, fmt.Sprintf(helpText, bot.Self.UserName))
+	msg.ReplyMarkup = genButton()
+	msg.ParseMode = tgbotapi.ModeHTML
+	return
+}
 
-	case "addlist":
-		msg.ReplyMarkup = genButton()
-		msg.Text = "In development. Later it will be possible to add custom lists."
-	case "vault":
-		msg.ReplyMarkup = genButton()
-		msg.Text = "In development. Later you'll have access to your vault, where passwords are stored"
-	case "encryption":
-		msg.ReplyMarkup = genButton()
-		msg.Text = "In development. Setup your encryption settings. Disable/enable encryption and change password for encryption"
-	case "search":
-		msg.ReplyMarkup = genButton()
-		msg.Text = "In development. Search your stored passphrases"
+// handleNumberCommand waits for the number of words in generated passphrases
+func handleNumberCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	setLastAction(ctx, laSetNubmer)
+	msg = tgbotapi.NewMessage(m.Chat.ID, "Choose number of words in the passphrases that will be generated. The value have to contain only numbers and nothing more.")
+	msg.ReplyMarkup = IKBCancelAction
+	return
+}
 
-	default:
-		msg.ReplyMarkup = genButton()
-		msg.Text = "Unknown command, sorry. Type /help to get help."
-		logger.Warn("Got unknown command from user", zap.String("command", m.Command()))
+// handleStrengthCommand waits for the target entropy of generated passphrases
+func handleStrengthCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	setLastAction(ctx, laSetStrength)
+	msg = tgbotapi.NewMessage(m.Chat.ID, fmt.Sprintf("Type the minimal strength of the passphrases in bits, from %d to %d. For example, 80 is enough for most accounts. The number of words will be chosen for your wordlist automatically. To use the fixed number of words again, type /number", minbits, maxbits))
+	msg.ReplyMarkup = IKBCancelAction
+	return
+}
+
+// handleSepCommand waits for the separator in generated passphrases
+func handleSepCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	setLastAction(ctx, laSetSeparator)
+	msg = tgbotapi.NewMessage(m.Chat.ID, "Type separator of the passphrases that will be generated. It can be <code>-</code> or <code>_</code> or even newline, for instance. Separator has to be less than 10 bytes long.\nTo set space as a separator, type <code>\\</code> (just backslash). For newline, type <code>\\n</code>. Note that first backslash will be removed from any of your messages (if you use it), so for one backslash as a separator you have to specify two backslashes.")
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = IKBCancelAction
+	return
+}
+
+// handleTransformCommand shows transformations of the person
+func handleTransformCommand(ctx context.Context, st Storage, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "")
+	s, err := st.Settings(ctx, m.Chat.ID)
+	if err != nil {
+		logger.Error("Can't get transformations", zap.Error(err), zap.Int64("personid", m.Chat.ID))
+		msg.Text = "Can't get your settings. Sorry."
+		return
+	}
+	msg.Text = transformsText()
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = IKBTransforms(s.Transform)
+	return
+}
+
+// handlePolicyCommand shows policies with the current one marked
+func handlePolicyCommand(ctx context.Context, st Storage, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "")
+	text, ikb, err := policyMessage(ctx, st, m.Chat.ID)
+	if err != nil {
+		logger.Error("Can't get policy of user", zap.Error(err), zap.Int64("personid", m.Chat.ID))
+		msg.Text = "Can't get your settings. Sorry."
+		return
+	}
+	msg.Text = text
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = ikb
+	return
+}
+
+// handleBIP39Command shows the BIP39 mode of the person
+func handleBIP39Command(ctx context.Context, st Storage, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "")
+	s, err := st.Settings(ctx, m.Chat.ID)
+	if err != nil {
+		logger.Error("Can't get BIP39 mode", zap.Error(err), zap.Int64("personid", m.Chat.ID))
+		msg.Text = "Can't get your settings. Sorry."
+		return
+	}
+	msg.Text = mnemonicSettingsText(s.Mnemonic)
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = IKBMnemonic(s.Mnemonic)
+	return
+}
+
+// handleListCommand shows wordlists, the uploaded one is added if there is one
+func handleListCommand(ctx context.Context, st Storage, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	var custom *Wordlist
+	if ul, err := st.UserList(ctx, m.Chat.ID); err == nil {
+		custom = ul.Wordlist()
+	}
+	msg = tgbotapi.NewMessage(m.Chat.ID, wordlistsDescription())
+	msg.ReplyMarkup = IKBWordlistChooser(custom)
+	msg.ParseMode = tgbotapi.ModeHTML
+	return
+}
+
+// handleVaultCommand shows the first page of the vault
+func handleVaultCommand(conn RedisConn, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "")
+	text, ikb, err := vaultPage(conn, m.Chat.ID, 0)
+	if err != nil {
+		logger.Error("Can't get vault of user", zap.Error(err), zap.Int64("personid", m.Chat.ID))
+		msg.Text = "Can't open your vault. Sorry."
+		return
+	}
+	msg.Text = text
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = ikb
+	return
+}
+
+// handleEncryptionCommand shows encryption settings of the person
+func handleEncryptionCommand(conn RedisConn, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "")
+	text, ikb, err := encryptionSettings(conn, m.Chat.ID)
+	if err != nil {
+		logger.Error("Can't get encryption settings of user", zap.Error(err), zap.Int64("personid", m.Chat.ID))
+		msg.Text = "Can't get your encryption settings. Sorry."
 		return
 	}
+	msg.Text = text
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = ikb
+	return
+}
 
+// handleUnknownCommand answers to commands that aren't registered
+func handleUnknownCommand(ctx context.Context, m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(m.Chat.ID, "Unknown command, sorry. Type /help to get help.")
+	msg.ReplyMarkup = genButton()
+	logger.Warn("Got unknown command from user", zap.String("command", m.Command()))
 	return
 }
 
@@ -278,57 +330,67 @@ func handleUnknowMessage(m *tgbotapi.Message) (msg tgbotapi.MessageConfig) {
 	return
 }
 
-// handleInlineButtonClick is called when user clicked the button on inline keyboard
-func handleInlineButtonClick(ctx context.Context, cq *tgbotapi.CallbackQuery) {
-
-	if complexDataParts := strings.Split(cq.Data, "$$"); len(complexDataParts) == 2 {
-		switch complexDataParts[0] {
-		case "system":
-			switch complexDataParts[1] {
-			case "cancel":
-				deleteMessage(cq.From.ID, cq.Message.MessageID)
-			case "cancelaction":
-				deleteMessage(cq.From.ID, cq.Message.MessageID)
-				removeLastAction(ctx)
-				callbackAnswer(cq.ID, "Last action successfully removed!")
-			}
-		case "setwl":
-			if c, ok := ctx.Value("redis-conn").(RedisConn); ok {
-				wl, err := strconv.Atoi(complexDataParts[1])
-				if err != nil {
-					logger.Error("Can't convert to int second part of cq data", zap.Error(err))
-					return
-				}
-				err = c.NewRedisSetRequest().SetPersonList(cq.From.ID, WL(wl))
-				if err != nil {
-					logger.Error("Can't set person's list", zap.Error(err))
-					return
-				}
-				callbackAnswer(cq.ID, fmt.Sprintf("%s is your new wordlist", WL(wl).ShortName()))
-				logger.Info("Changed wordlist of user", zap.Int64("personid", cq.From.ID))
-				return
-
-			} else {
-				logger.Error("Can't get redis conn from context", zap.Error(ErrCantParseCtx))
-			}
-		}
-		return
-	}
-
-	switch cq.Data {
-	case "regenerate":
-		err := regeneratePassword(ctx, cq)
-		if err != nil {
-			logger.Error("Can't regenerate a password", zap.Error(err))
-		}
-	case "delete":
+// handleSystemCallback closes the message with the keyboard. "cancelaction"
+// also removes the last action, so the bot stops waiting for the text
+func handleSystemCallback(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+	switch arg {
+	case "cancel":
 		deleteMessage(cq.Message.Chat.ID, cq.Message.MessageID)
-	case "save":
-		savePassword(cq.From.ID, cq.Message.Text)
-		callbackAnswer(cq.ID, "Your password wasn't saved. This functionality is under maintenance.")
+	case "cancelaction":
+		deleteMessage(cq.From.ID, cq.Message.MessageID)
+		removeLastAction(ctx)
+		callbackAnswer(cq.ID, "Last action successfully removed!")
+	}
+	return nil
+}
 
+// handleWordlistCallback sets the wordlist. The wordlist is a setting of the chat with the keyboard
+func handleWordlistCallback(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		return ErrCantParseCtx
+	}
+	chatID := cq.Message.Chat.ID
+	if !canChangeChatSettings(cq) {
+		callbackAnswer(cq.ID, ErrNotChatAdmin.Error())
+		return nil
+	}
+	wl := WL(arg)
+	if _, ok := Wordlists[wl]; !ok && wl != userwl {
+		return ErrInvalidWL
 	}
+	if wl == userwl && isGroup(cq.Message.Chat) {
+		return nil
+	}
+	err := updateSettings(ctx, st, chatID, func(s *Settings) { s.Wordlist = wl })
+	if err != nil {
+		logger.Error("Can't set person's list", zap.Error(err))
+		return err
+	}
+	_, custom := personWordlist(ctx, st, chatID, wl)
+	if custom != nil {
+		callbackAnswer(cq.ID, fmt.Sprintf("%s is your new wordlist", custom.Name()))
+	} else {
+		callbackAnswer(cq.ID, fmt.Sprintf("%s is your new wordlist", wl.ShortName()))
+	}
+	logger.Info("Changed wordlist of user", zap.Int64("personid", cq.From.ID))
+	return nil
+}
 
+// handleGenerateText generates the passphrase after the click on Generate button
+func handleGenerateText(ctx context.Context, m *tgbotapi.Message) error {
+	deleteMessage(m.Chat.ID, m.MessageID)
+	return generatePassphrase(ctx, m.Chat.ID)
+}
+
+// handleBatchText sends candidates after the click on the button of the batch
+func handleBatchText(ctx context.Context, m *tgbotapi.Message) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		return ErrCantParseCtx
+	}
+	deleteMessage(m.Chat.ID, m.MessageID)
+	return sendSelfDestructing(ctx, st, m.Chat.ID, batchMessage(ctx, st, m.Chat.ID, batchDefault))
 }
 
 // deleteMessage takes chatID and messageID and tries to delete it
@@ -344,43 +406,27 @@ func callbackAnswer(cqID string, text string) {
 	bot.Request(c)
 }
 
-// regeneratePassword context with redis connection and callback query
+// regeneratePassword context with storage and callback query
 // and tries to edit it with new generated password
 func regeneratePassword(ctx context.Context, cq *tgbotapi.CallbackQuery) error {
-	chatID := cq.From.ID
+	// Settings of the chat with the message are used, they are personal only in private chats
+	chatID := cq.Message.Chat.ID
 	msgID := cq.Message.MessageID
 
 	// Get list of a user
-	if rc, ok := ctx.Value("redis-conn").(RedisConn); ok {
-		rg := rc.NewRedisGetRequest().ID(chatID)
-		wl := rg.GetPersonList()
-		n := func() int {
-			if n, err := rg.GetWordsNumber(); err == nil {
-				if n > 0 {
-					return n
-				} else {
-					logger.Error("Amount of words is less than 1")
-					return deflen
-				}
-			} else {
-				logger.Warn("Can't get words number", zap.Error(err))
-				return deflen
-			}
-		}()
-
-		sep, err := rg.GetSeparator()
-		if err != nil {
-			logger.Warn("Can't get separator", zap.Error(err))
-			sep = defsep
-		}
-		gpc := NewGeneratePasswordConfig().Wordlist(wl).Length(n).Separator(sep)
+	if st, ok := ctx.Value("storage").(Storage); ok {
+		gpc := personGenerateConfig(ctx, st, chatID)
 		passphrase, err := gpc.Generate()
+		if errors.Is(err, ErrPolicyUnsatisfiable) {
+			callbackAnswer(cq.ID, err.Error())
+			return nil
+		}
 		if err != nil {
 			logger.Error("Can't generate password", zap.Error(err), zap.Any("config", gpc))
 			return err
 		}
 
-		ec := tgbotapi.NewEditMessageText(chatID, msgID, fmt.Sprintf("<code>%s</code>", tgbotapi.EscapeText(tgbotapi.ModeHTML, passphrase)))
+		ec := tgbotapi.NewEditMessageText(chatID, msgID, passphraseText(passphrase, gpc.Strength()))
 		ec.ParseMode = tgbotapi.ModeHTML
 		ec.ReplyMarkup = inlPasswordOptions()
 		_, err = bot.Request(ec)
@@ -389,78 +435,78 @@ func regeneratePassword(ctx context.Context, cq *tgbotapi.CallbackQuery) error {
 			return err
 		}
 
-		callbackAnswer(cq.ID, fmt.Sprintf("You use %s wordlist", wl.ShortName()))
+		callbackAnswer(cq.ID, fmt.Sprintf("You use %s wordlist", gpc.list().Name()))
 
 		return nil
 	}
 
-	logger.Error("Can't get redis connection from the context")
-	return ErrCantConnRedis
+	logger.Error("Can't get storage from the context")
+	return ErrCantParseCtx
+}
+
+// personGenerateConfig returns the config built from settings of the person.
+// Default values are used for settings that can't be read
+func personGenerateConfig(ctx context.Context, st Storage, personID int64) *GeneratePasswordConfig {
+	s, err := st.Settings(ctx, personID)
+	if err != nil {
+		logger.Warn("Can't get settings", zap.Error(err), zap.Int64("personid", personID))
+		s = defaultSettings()
+	}
+
+	wl, custom := personWordlist(ctx, st, personID, s.Wordlist)
+	gpc := NewGeneratePasswordConfig().Wordlist(wl).UserWordlist(custom).Length(s.Words).Separator(s.Separator)
+	if s.TargetBits > 0 {
+		gpc.TargetEntropy(float64(s.TargetBits))
+	}
+	gpc.Transform(s.Transform)
+	if p, err := personPolicy(ctx, st, personID, s.PolicyID); err == nil {
+		gpc.Policy(p)
+	} else {
+		logger.Warn("Can't get policy", zap.Error(err))
+	}
+	if validMnemonicLength(s.Mnemonic) {
+		gpc.Mnemonic(s.Mnemonic)
+	}
+	return gpc
 }
 
 // generatePassphrase takes the slice of words,
 // amount of words and a separator. Mnemonic password will be returned
 func generatePassphrase(ctx context.Context, chatID int64) error {
 
-	if rc, ok := ctx.Value("redis-conn").(RedisConn); ok {
-		rg := rc.NewRedisGetRequest().ID(chatID)
-		wl := rg.GetPersonList()
-		n := func() int {
-			if n, err := rg.GetWordsNumber(); err == nil {
-				if n > 0 {
-					return n
-				} else {
-					logger.Error("Amount of words is less than 1", zap.Int64("personid", chatID))
-					return deflen
-				}
-			} else {
-				logger.Warn("Can't get words number from redis", zap.Error(err))
-				return deflen
-			}
-		}()
-
-		sep, err := rg.GetSeparator()
-		if err != nil {
-			logger.Warn("Can't get separator", zap.Error(err))
-			sep = defsep
-		}
-		gpc := NewGeneratePasswordConfig().Wordlist(wl).Length(n).Separator(sep)
+	if st, ok := ctx.Value("storage").(Storage); ok {
+		gpc := personGenerateConfig(ctx, st, chatID)
 		passphrase, err := gpc.Generate()
+		if errors.Is(err, ErrPolicyUnsatisfiable) {
+			msg := tgbotapi.NewMessage(chatID, err.Error()+". Change the policy with /policy")
+			_, err = bot.Send(msg)
+			return err
+		}
 		if err != nil {
 			logger.Error("Can't create a new generate password config", zap.Error(err))
 			return err
 		}
 
-		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("<code>%s</code>", tgbotapi.EscapeText(tgbotapi.ModeHTML, passphrase)))
+		msg := tgbotapi.NewMessage(chatID, passphraseText(passphrase, gpc.Strength()))
 		msg.ParseMode = tgbotapi.ModeHTML
 		msg.ReplyMarkup = inlPasswordOptions()
-		_, err = bot.Send(msg)
-		if err != nil {
+		if err := sendSelfDestructing(ctx, st, chatID, msg); err != nil {
 			return err
 		}
 
 		return nil
 	}
 
-	logger.Error("Can't parse connection from the context", zap.Error(ErrCantConnRedis))
-	return errors.New("Can't connect to Redis")
-}
-
-// savePassword encrypts and saves user's password in the database
-func savePassword(userID int64, password string) {
-	// TODO
-	// fmt.Println("Imagine like I'm encrypting and saving password", password, "in the database. UserID =", userID)
-}
-
-// savePassword encrypts and saves user's password in the database
-func savePasswordNote(userID int64, password string, note string) {
-	// TODO
-	// fmt.Println("Imagine like I'm encrypting and saving password", password, "in the database. UserID =", userID)
+	logger.Error("Can't parse storage from the context", zap.Error(ErrCantParseCtx))
+	return ErrCantParseCtx
 }
 
 // genButton returns replyMarkup keyboard with one word Generate
 func genButton() tgbotapi.ReplyKeyboardMarkup {
-	return tgbotapi.NewReplyKeyboard(tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("Generate")))
+	return tgbotapi.NewReplyKeyboard(tgbotapi.NewKeyboardButtonRow(
+		tgbotapi.NewKeyboardButton("Generate"),
+		tgbotapi.NewKeyboardButton(batchButton),
+	))
 }
 
 // inlPasswordOptions returns replyMarkup as an inline keyboard with the following options:
@@ -477,10 +523,37 @@ func inlPasswordOptions() *tgbotapi.InlineKeyboardMarkup {
 		// tgbotapi.NewInlineKeyboardRow(
 		// 	tgbotapi.NewInlineKeyboardButtonData("🔀 Regenerate passphrase", "regenerate"),
 		// ),
-		// tgbotapi.NewInlineKeyboardRow(
-		// 	tgbotapi.NewInlineKeyboardButtonData("💾 Save", "save"),
-		// 	tgbotapi.NewInlineKeyboardButtonData("🖊️ Save with note", "save_with_name"),
-		// ),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💾 Save", "save"),
+			tgbotapi.NewInlineKeyboardButtonData("🖊️ Save with note", "save_with_name"),
+		),
+	)
+
+	return &inlineKeyboard
+}
+
+// inlDicePassphraseOptions returns replyMarkup as an inline keyboard for the passphrase
+// made from dice rolls. It can't be regenerated, because the server doesn't roll the dice
+func inlDicePassphraseOptions() *tgbotapi.InlineKeyboardMarkup {
+	inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🗑️ Delete", "delete"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💾 Save", "save"),
+			tgbotapi.NewInlineKeyboardButtonData("🖊️ Save with note", "save_with_name"),
+		),
+	)
+
+	return &inlineKeyboard
+}
+
+// inlDeleteOnly returns replyMarkup as an inline keyboard with one delete button
+func inlDeleteOnly() *tgbotapi.InlineKeyboardMarkup {
+	inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🗑️ Delete", "delete"),
+		),
 	)
 
 	return &inlineKeyboard
@@ -490,16 +563,33 @@ func NewRedisPool(address string) *redis.Pool {
 	return &redis.Pool{
 		MaxIdle:   80,
 		MaxActive: 12000, // max number of connections
+		// Commands get the error instead of the panic if Redis is down
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", address)
-			if err != nil {
-				panic(err.Error())
-			}
-			return c, err
+			return redis.Dial("tcp", address, redis.DialConnectTimeout(redisTimeout))
 		},
 	}
 }
 
+// parseSeparator converts the separator typed by the user: single backslash
+// is a space, \n is a newline and the first backslash is removed from the rest
+func parseSeparator(value string) (string, error) {
+	if !strkit.Fitsb(value, 8) {
+		return "", ErrSeparatorTooLong
+	}
+
+	switch value {
+	case `\`:
+		value = " "
+	case `\n`:
+		value = "\n"
+	default:
+		if len(value) > 1 && value[0] == '\\' {
+			value = value[1:]
+		}
+	}
+	return value, nil
+}
+
 // Try to parse integer
 // 0 is returned if it's impossible to do so
 func ParseInt(s string) int {
@@ -510,111 +600,219 @@ func ParseInt(s string) int {
 	return n
 }
 
-func handleLastActionText(ctx context.Context) error {
+// secretText deletes the message of the person before it's handled,
+// so passwords, notes, dice rolls and mnemonics don't stay in the chat
+func secretText(h LastActionFunc) LastActionFunc {
+	return func(ctx context.Context, conn RedisConn, la LastAction, m *tgbotapi.Message) error {
+		deleteMessage(m.Chat.ID, m.MessageID)
+		return h(ctx, conn, la, m)
+	}
+}
 
-	conn, ok := ctx.Value("redis-conn").(RedisConn)
+// handleNumberText sets number of words typed after /number
+func handleNumberText(ctx context.Context, conn RedisConn, la LastAction, m *tgbotapi.Message) error {
+	st, ok := ctx.Value("storage").(Storage)
 	if !ok {
-		log.Println(ErrCantParseCtx)
 		return ErrCantParseCtx
 	}
+	pid := m.Chat.ID
+	msg := tgbotapi.NewMessage(pid, "Error!")
 
-	la, err := getLastAction(ctx)
+	n := ParseInt(m.Text)
+	if n <= 0 {
+		msg.Text = "Number of words have to be positive"
+		msg.ReplyMarkup = IKBCancelAction
+		bot.Send(msg)
+		return ErrNumberOfWordsLessThanZero
+	}
+	if n > maxlen {
+		msg.Text = fmt.Sprintf("Number of words have to be less than %d", maxlen)
+		msg.ReplyMarkup = IKBCancelAction
+		bot.Send(msg)
+		return ErrNumberOfWordsTooBig
+	}
+	// Fixed number of words replaces the target strength
+	err := updateSettings(ctx, st, pid, func(s *Settings) {
+		s.Words = n
+		s.TargetBits = 0
+	})
 	if err != nil {
-		logger.Error("Can't get last action", zap.Error(err))
+		msg.Text = "Can't set number of words"
+		msg.ReplyMarkup = IKBCancelAction
+		bot.Send(msg)
+		logger.Error("Can't set number of words", zap.Error(err))
 		return err
 	}
+	msg.Text = "Number of words successfully changed!"
+	bot.Send(msg)
+	return removeLastAction(ctx)
+}
 
-	value, ok := ctx.Value("msg").(string)
+// handleStrengthText sets target entropy typed after /strength
+func handleStrengthText(ctx context.Context, conn RedisConn, la LastAction, m *tgbotapi.Message) error {
+	st, ok := ctx.Value("storage").(Storage)
 	if !ok {
-		logger.Info("Can't get message", zap.Error(ErrCantParseCtx))
 		return ErrCantParseCtx
 	}
+	pid := m.Chat.ID
+	msg := tgbotapi.NewMessage(pid, "Error!")
 
-	pid, ok := ctx.Value("person").(int64)
+	bits := ParseInt(m.Text)
+	if bits < minbits || bits > maxbits {
+		msg.Text = fmt.Sprintf("Strength has to be a number from %d to %d", minbits, maxbits)
+		msg.ReplyMarkup = IKBCancelAction
+		bot.Send(msg)
+		return ErrTargetEntropyOutOfRange
+	}
+	if err := updateSettings(ctx, st, pid, func(s *Settings) { s.TargetBits = bits }); err != nil {
+		msg.Text = "Can't set the strength"
+		msg.ReplyMarkup = IKBCancelAction
+		bot.Send(msg)
+		logger.Error("Can't set target entropy", zap.Error(err))
+		return err
+	}
+	gpc := personGenerateConfig(ctx, st, pid)
+	if gpc.Valid() && gpc.Entropy() < float64(bits) {
+		msg.Text = fmt.Sprintf("Strength is changed, but %d bits can't be reached with %s wordlist and your /policy.", bits, gpc.list().Name())
+	} else if gpc.Valid() {
+		msg.Text = fmt.Sprintf("Strength successfully changed! With %s wordlist passphrases will have %d words (%.1f bits).", gpc.list().Name(), gpc.WordCount(), gpc.Entropy())
+	} else {
+		msg.Text = "Strength successfully changed!"
+	}
+	bot.Send(msg)
+	return removeLastAction(ctx)
+}
+
+// handleSeparatorText sets separator typed after /sep
+func handleSeparatorText(ctx context.Context, conn RedisConn, la LastAction, m *tgbotapi.Message) error {
+	st, ok := ctx.Value("storage").(Storage)
 	if !ok {
-		log.Println(ErrCantParseCtx)
 		return ErrCantParseCtx
 	}
-
+	pid := m.Chat.ID
 	msg := tgbotapi.NewMessage(pid, "Error!")
 
-	switch la {
-	case laSetNubmer:
-		if n := ParseInt(value); n > 0 {
-			if n > 200 {
-				msg.Text = "Number of words have to be less than 200"
-				msg.ReplyMarkup = IKBCancelAction
-				bot.Send(msg)
-				log.Println(ErrNumberOfWordsTooBig)
-				return ErrNumberOfWordsTooBig
-			}
-			err := conn.NewRedisSetRequest().SetNumberOfWords(pid, n)
-			if err != nil {
-				msg.Text = "Can't set number of words"
-				msg.ReplyMarkup = IKBCancelAction
-				bot.Send(msg)
-				logger.Error("Can't set number of words", zap.Error(err))
-				return err
-			}
-			msg.Text = "Number of words successfully changed!"
-			bot.Send(msg)
-			return removeLastAction(ctx)
-		} else {
-			msg.Text = "Number of words have to be positive"
-			msg.ReplyMarkup = IKBCancelAction
-			bot.Send(msg)
-			log.Println(ErrNumberOfWordsLessThanZero)
-			return ErrNumberOfWordsLessThanZero
-		}
-	case laSetSeparator:
-		if strkit.Fitsb(value, 8) {
-			switch value {
-			case `\`:
-				value = " "
-			case `\n`:
-				value = "\n"
-			default:
-				if len(value) > 1 && value[0] == '\\' {
-					value = value[1:]
-				}
-			}
-			err := conn.NewRedisSetRequest().SetSeparator(pid, value)
-			if err != nil {
-				msg.Text = "Error on the server side. Sorry."
-				bot.Send(msg)
-				logger.Error("Can't set separator", zap.Error(err), zap.Int64("personid", pid), zap.String("separator", value))
-				return err
-			}
-
-			msg.Text = "Separator successfully changed"
-			bot.Send(msg)
-			logger.Info("Changed separator of user", zap.Int64("personid", msg.ChatID), zap.Int("seplength", len(value)))
-			return removeLastAction(ctx)
-		} else {
-			msg.Text = "Separator have to be less than 8 bytes long"
-			msg.ReplyMarkup = IKBCancelAction
-			bot.Send(msg)
-			log.Println(ErrSeparatorTooLong)
-			return ErrSeparatorTooLong
+	value, err := parseSeparator(m.Text)
+	if err != nil {
+		msg.Text = "Separator have to be less than 8 bytes long"
+		msg.ReplyMarkup = IKBCancelAction
+		bot.Send(msg)
+		return ErrSeparatorTooLong
+	}
+	if err := updateSettings(ctx, st, pid, func(s *Settings) { s.Separator = value }); err != nil {
+		msg.Text = "Error on the server side. Sorry."
+		bot.Send(msg)
+		logger.Error("Can't set separator", zap.Error(err), zap.Int64("personid", pid), zap.String("separator", value))
+		return err
+	}
+
+	msg.Text = "Separator successfully changed"
+	bot.Send(msg)
+	logger.Info("Changed separator of user", zap.Int64("personid", pid), zap.Int("seplength", len(value)))
+	return removeLastAction(ctx)
+}
+
+// handleEncPassAction handles the encryption password in every step of /encryption
+func handleEncPassAction(ctx context.Context, conn RedisConn, la LastAction, m *tgbotapi.Message) error {
+	msg, done, err := handleEncPassText(conn, m.Chat.ID, la, m.Text)
+	bot.Send(msg)
+	if !done {
+		if err == nil && la == laChangeEncPass {
+			return setLastAction(ctx, laNewEncPass)
 		}
-	case laSetEncPass:
-		return removeLastAction(ctx)
+		return err
+	}
+	removeLastAction(ctx)
+	return err
+}
 
+// handleVaultNoteAction saves the note of the passphrase
+func handleVaultNoteAction(ctx context.Context, conn RedisConn, la LastAction, m *tgbotapi.Message) error {
+	msg, saved, err := handleVaultNote(conn, m.Chat.ID, m.Text)
+	bot.Send(msg)
+	if errors.Is(err, ErrNoteTooLong) {
+		return err
+	}
+	if err != nil || saved {
+		removeLastAction(ctx)
+		return err
+	}
+	return setLastAction(ctx, laVaultSave)
+}
+
+// handleVaultPasswordAction handles the encryption password that opens the vault
+func handleVaultPasswordAction(ctx context.Context, conn RedisConn, la LastAction, m *tgbotapi.Message) error {
+	arg, err := getLastActionArg(ctx)
+	if err != nil {
+		return err
+	}
+	msg, err := handleVaultPassword(conn, m.Chat.ID, la, arg, m.Text)
+	bot.Send(msg)
+	if errors.Is(err, ErrWrongEncPass) {
+		// Let the user try again
+		return err
 	}
 	removeLastAction(ctx)
+	return err
+}
 
-	return nil
+// handleDiceRollsAction maps dice rolls typed after /dice to the passphrase
+func handleDiceRollsAction(ctx context.Context, conn RedisConn, la LastAction, m *tgbotapi.Message) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		return ErrCantParseCtx
+	}
+	msg, done, err := handleDiceRolls(ctx, st, m.Chat.ID, m.Text)
+	if done && err == nil {
+		sendSelfDestructing(ctx, st, m.Chat.ID, msg)
+	} else {
+		bot.Send(msg)
+	}
+	if done {
+		removeLastAction(ctx)
+	}
+	return err
+}
 
+// handleValidateAction validates the mnemonic sent after /validate
+func handleValidateAction(ctx context.Context, conn RedisConn, la LastAction, m *tgbotapi.Message) error {
+	msg := tgbotapi.NewMessage(m.Chat.ID, mnemonicValidationText(m.Text))
+	msg.ParseMode = tgbotapi.ModeHTML
+	bot.Send(msg)
+	return removeLastAction(ctx)
+}
+
+// handleDocument handles documents sent by the user.
+// Only wordlists after /addlist are expected
+func handleDocument(ctx context.Context, m *tgbotapi.Message) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		return ErrCantParseCtx
+	}
+
+	la, err := getLastAction(ctx)
+	if err != nil || la != laAddList {
+		botSend(handleUnknowMessage(m))
+		return err
+	}
+
+	msg, err := handleListDocument(ctx, st, m.Chat.ID, m.Document)
+	botSend(msg)
+	if err != nil {
+		// Let the user send the fixed list
+		return err
+	}
+	return removeLastAction(ctx)
 }
 
 func removeLastAction(ctx context.Context) error {
-	if conn, ok := ctx.Value("redis-conn").(RedisConn); ok {
+	if st, ok := ctx.Value("storage").(Storage); ok {
 		pid, ok := ctx.Value("person").(int64)
 		if !ok {
 			logger.Error("Can't get PersonID from context")
 			return ErrCantParseCtx
 		}
-		return conn.NewRedisDelRequest().ID(pid).DeleteLastAction()
+		return st.DeleteLastAction(ctx, pid)
 	}
 
 	log.Println(ErrCantParseCtx)
@@ -622,22 +820,22 @@ func removeLastAction(ctx context.Context) error {
 }
 
 func setLastAction(ctx context.Context, lastAction LastAction) error {
-	if conn, ok := ctx.Value("redis-conn").(RedisConn); ok {
+	if st, ok := ctx.Value("storage").(Storage); ok {
 		pid, ok := ctx.Value("person").(int64)
 		if !ok {
 			logger.Error("Can't get PersonID from context")
 			return ErrCantParseCtx
 		}
 
-		return conn.NewRedisSetRequest().SetLastAction(pid, lastAction)
+		return st.SetLastAction(ctx, pid, lastAction)
 
 	}
-	logger.Error("Can't get redis conn from context")
+	logger.Error("Can't get storage from context")
 	return ErrCantParseCtx
 }
 
 func getLastAction(ctx context.Context) (LastAction, error) {
-	if conn, ok := ctx.Value("redis-conn").(RedisConn); ok {
+	if st, ok := ctx.Value("storage").(Storage); ok {
 		pid, ok := ctx.Value("person").(int64)
 
 		if !ok {
@@ -645,13 +843,43 @@ func getLastAction(ctx context.Context) (LastAction, error) {
 			return "", ErrCantParseCtx
 		}
 
-		return conn.NewRedisGetRequest().ID(pid).GetLastAction()
+		return st.LastAction(ctx, pid)
 
 	}
-	logger.Error("Can't get connection from context")
+	logger.Error("Can't get storage from context")
 	return "", ErrCantParseCtx
 }
 
+// setLastActionArg sets argument of the last action, for example ID of the vault entry
+func setLastActionArg(ctx context.Context, arg string) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		logger.Error("Can't get storage from context")
+		return ErrCantParseCtx
+	}
+	pid, ok := ctx.Value("person").(int64)
+	if !ok {
+		logger.Error("Can't get PersonID from context")
+		return ErrCantParseCtx
+	}
+	return st.SetLastActionArg(ctx, pid, arg)
+}
+
+// getLastActionArg returns argument of the last action, empty string if there is none
+func getLastActionArg(ctx context.Context) (string, error) {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		logger.Error("Can't get storage from context")
+		return "", ErrCantParseCtx
+	}
+	pid, ok := ctx.Value("person").(int64)
+	if !ok {
+		logger.Error("Can't get PersonID from context")
+		return "", ErrCantParseCtx
+	}
+	return st.LastActionArg(ctx, pid)
+}
+
 func NewLogger() *zap.Logger {
 	fileInfo, err := os.OpenFile("log_info.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const lastActionTTL = time.Hour // The same time as in Redis
+
+// memoryStorage keeps everything in the memory of the bot. With a path
+// it's the file storage: the data is written to the file after every change
+// and read from it at the start, so it survives restarts. Last actions
+// are kept only in the memory
+type memoryStorage struct {
+	mu   sync.Mutex
+	path string
+	data memoryData
+}
+
+// memoryData is the content of the file storage. Last actions live
+// for an hour, so they aren't written to the file
+type memoryData struct {
+	Settings    map[int64]settingsState     `json:"settings"`
+	LastActions map[int64]lastActionState   `json:"-"`
+	Policies    map[int64]map[string]Policy `json:"policies"`
+	Lists       map[int64]UserWordlist      `json:"lists"`
+	Deletions   map[string]int64            `json:"deletions"` // Scheduled deletion and its unix time
+}
+
+// settingsState is settings of the chat with their lifetime, which is
+// extended on every use like in Redis. Files without it get the full lifetime
+type settingsState struct {
+	Settings
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+type lastActionState struct {
+	Action  LastAction `json:"action"`
+	Arg     string     `json:"arg,omitempty"`
+	Expires time.Time  `json:"expires"`
+}
+
+// NewMemoryStorage returns storage that is lost on restart.
+// It's enough for tests and for trying the bot
+func NewMemoryStorage() *memoryStorage {
+	return &memoryStorage{data: newMemoryData()}
+}
+
+// NewFileStorage returns storage kept in the file. The file is created if it doesn't exist
+func NewFileStorage(path string) (*memoryStorage, error) {
+	m := &memoryStorage{path: path, data: newMemoryData()}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m.data); err != nil {
+		return nil, err
+	}
+	m.data.init()
+	m.data.prune(time.Now())
+	return m, nil
+}
+
+func newMemoryData() memoryData {
+	var d memoryData
+	d.init()
+	return d
+}
+
+// init creates maps that are missing in the file
+func (d *memoryData) init() {
+	if d.Settings == nil {
+		d.Settings = make(map[int64]settingsState)
+	}
+	if d.LastActions == nil {
+		d.LastActions = make(map[int64]lastActionState)
+	}
+	if d.Policies == nil {
+		d.Policies = make(map[int64]map[string]Policy)
+	}
+	if d.Lists == nil {
+		d.Lists = make(map[int64]UserWordlist)
+	}
+	if d.Deletions == nil {
+		d.Deletions = make(map[string]int64)
+	}
+}
+
+// prune drops settings and last actions whose time is over.
+// Settings without the time get the full lifetime
+func (d *memoryData) prune(now time.Time) {
+	for id, s := range d.Settings {
+		switch {
+		case s.Expires.IsZero():
+			s.Expires = now.Add(settingsTTL)
+			d.Settings[id] = s
+		case now.After(s.Expires):
+			delete(d.Settings, id)
+		}
+	}
+	for id, la := range d.LastActions {
+		if now.After(la.Expires) {
+			delete(d.LastActions, id)
+		}
+	}
+}
+
+// save writes the data to the file. A temporary file is renamed,
+// so the file isn't broken if the bot stops while writing.
+// It has to be called with the lock held
+func (m *memoryStorage) save() error {
+	m.data.prune(time.Now())
+	if m.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(m.data)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
+
+// lock takes the lock unless ctx is already cancelled
+func (m *memoryStorage) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	return nil
+}
+
+func (m *memoryStorage) Settings(ctx context.Context, chatID int64) (Settings, error) {
+	if err := m.lock(ctx); err != nil {
+		return Settings{}, err
+	}
+	defer m.mu.Unlock()
+
+	s, ok := m.data.Settings[chatID]
+	if !ok || time.Now().After(s.Expires) {
+		return defaultSettings(), nil
+	}
+	// It's written to the file with the next change
+	s.Expires = time.Now().Add(settingsTTL)
+	m.data.Settings[chatID] = s
+	return upgradeSettings(s.Settings)
+}
+
+func (m *memoryStorage) SaveSettings(ctx context.Context, chatID int64, s Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	s.Version = settingsVersion
+
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	m.data.Settings[chatID] = settingsState{Settings: s, Expires: time.Now().Add(settingsTTL)}
+	return m.save()
+}
+
+func (m *memoryStorage) DeleteSettings(ctx context.Context, chatID int64) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	if s, ok := m.data.Settings[chatID]; ok && s.PrivateDelivery {
+		s.Settings = resetSettings(s.Settings)
+		m.data.Settings[chatID] = s
+	} else {
+		delete(m.data.Settings, chatID)
+	}
+	return m.save()
+}
+
+// lastAction returns state of the last action if it hasn't expired.
+// It has to be called with the lock held
+func (m *memoryStorage) lastAction(personID int64) lastActionState {
+	la, ok := m.data.LastActions[personID]
+	if !ok || time.Now().After(la.Expires) {
+		return lastActionState{}
+	}
+	return la
+}
+
+func (m *memoryStorage) LastAction(ctx context.Context, personID int64) (LastAction, error) {
+	if err := m.lock(ctx); err != nil {
+		return "", err
+	}
+	defer m.mu.Unlock()
+	return m.lastAction(personID).Action, nil
+}
+
+func (m *memoryStorage) LastActionArg(ctx context.Context, personID int64) (string, error) {
+	if err := m.lock(ctx); err != nil {
+		return "", err
+	}
+	defer m.mu.Unlock()
+	return m.lastAction(personID).Arg, nil
+}
+
+func (m *memoryStorage) SetLastAction(ctx context.Context, personID int64, la LastAction) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	state := m.lastAction(personID)
+	state.Action = la
+	state.Expires = time.Now().Add(lastActionTTL)
+	m.data.LastActions[personID] = state
+	return nil
+}
+
+func (m *memoryStorage) SetLastActionArg(ctx context.Context, personID int64, arg string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	state := m.lastAction(personID)
+	state.Arg = arg
+	state.Expires = time.Now().Add(lastActionTTL)
+	m.data.LastActions[personID] = state
+	return nil
+}
+
+func (m *memoryStorage) DeleteLastAction(ctx context.Context, personID int64) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	delete(m.data.LastActions, personID)
+	return nil
+}
+
+func (m *memoryStorage) UserPolicies(ctx context.Context, personID int64) ([]Policy, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	policies := make([]Policy, 0, len(m.data.Policies[personID]))
+	for _, p := range m.data.Policies[personID] {
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies, nil
+}
+
+func (m *memoryStorage) UserPolicy(ctx context.Context, personID int64, id string) (Policy, error) {
+	if err := m.lock(ctx); err != nil {
+		return Policy{}, err
+	}
+	defer m.mu.Unlock()
+
+	p, ok := m.data.Policies[personID][id]
+	if !ok {
+		return p, ErrPolicyNotFound
+	}
+	return p, nil
+}
+
+func (m *memoryStorage) SaveUserPolicy(ctx context.Context, personID int64, p Policy) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	policies, ok := m.data.Policies[personID]
+	if !ok {
+		policies = make(map[string]Policy)
+		m.data.Policies[personID] = policies
+	}
+	if _, exists := policies[p.ID]; !exists && len(policies) >= policyMaxUser {
+		return ErrTooManyPolicies
+	}
+	policies[p.ID] = p
+	return m.save()
+}
+
+func (m *memoryStorage) DeleteUserPolicy(ctx context.Context, personID int64, id string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	if _, ok := m.data.Policies[personID][id]; !ok {
+		return ErrPolicyNotFound
+	}
+	delete(m.data.Policies[personID], id)
+	if s, ok := m.data.Settings[personID]; ok && s.PolicyID == id {
+		s.PolicyID = ""
+		m.data.Settings[personID] = s
+	}
+	return m.save()
+}
+
+func (m *memoryStorage) UserList(ctx context.Context, personID int64) (UserWordlist, error) {
+	if err := m.lock(ctx); err != nil {
+		return UserWordlist{}, err
+	}
+	defer m.mu.Unlock()
+
+	ul, ok := m.data.Lists[personID]
+	if !ok {
+		return ul, ErrNoUserList
+	}
+	return ul, nil
+}
+
+func (m *memoryStorage) SaveUserList(ctx context.Context, personID int64, ul UserWordlist) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	m.data.Lists[personID] = ul
+	return m.save()
+}
+
+func (m *memoryStorage) ScheduleDeletion(ctx context.Context, d ScheduledDeletion, at time.Time) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	m.data.Deletions[d.String()] = at.Unix()
+	return m.save()
+}
+
+func (m *memoryStorage) DueDeletions(ctx context.Context, now time.Time) ([]ScheduledDeletion, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	var due []ScheduledDeletion
+	for s, at := range m.data.Deletions {
+		if at > now.Unix() {
+			continue
+		}
+		d, err := parseScheduledDeletion(s)
+		if err != nil {
+			delete(m.data.Deletions, s)
+			continue
+		}
+		due = append(due, d)
+	}
+	return due, nil
+}
+
+func (m *memoryStorage) DeleteScheduledDeletion(ctx context.Context, d ScheduledDeletion) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	if _, ok := m.data.Deletions[d.String()]; !ok {
+		return nil
+	}
+	delete(m.data.Deletions, d.String())
+	return m.save()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	rateLimit  = 60          // Maximal number of updates of one person in rateWindow
+	rateWindow = time.Minute // Window of the rate limit
+)
+
+// routeName returns name of the handler set by the router
+func routeName(ctx context.Context) string {
+	name, _ := ctx.Value("route").(string)
+	return name
+}
+
+// recoverMiddleware turns panics of the handler into errors,
+// so one broken update doesn't stop the bot
+func recoverMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, upd tgbotapi.Update) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				logger.Error("Panic in handler", zap.Any("panic", p), zap.String("route", routeName(ctx)), zap.Stack("stack"))
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+		return next(ctx, upd)
+	}
+}
+
+// logMiddleware logs every handled update and its error
+func logMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, upd tgbotapi.Update) error {
+		start := time.Now()
+		err := next(ctx, upd)
+
+		fields := []zap.Field{zap.String("route", routeName(ctx)), zap.Duration("duration", time.Since(start))}
+		if pid, ok := ctx.Value("person").(int64); ok {
+			fields = append(fields, zap.Int64("personid", pid))
+		}
+		if err != nil {
+			logger.Error("Can't handle update", append(fields, zap.Error(err))...)
+			return err
+		}
+		logger.Info("Handled update", fields...)
+		return nil
+	}
+}
+
+// redisFailureMiddleware tells the person why the update can't be handled
+// when Redis doesn't answer in time or the bot runs without it
+func redisFailureMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, upd tgbotapi.Update) error {
+		err := next(ctx, upd)
+		if !isRedisFailure(err) {
+			return err
+		}
+
+		text := "The bot is overloaded right now. Try again in a minute."
+		if errors.Is(err, ErrNoRedis) {
+			text = "The vault isn't available on this bot, it runs without Redis."
+		}
+		switch {
+		case upd.CallbackQuery != nil:
+			callbackAnswer(upd.CallbackQuery.ID, text)
+		case upd.Message != nil:
+			botSend(tgbotapi.NewMessage(upd.Message.Chat.ID, text))
+		}
+		return err
+	}
+}
+
+// userMiddleware puts ID of the person who sent the update into the context.
+// Updates without the sender are ignored
+func userMiddleware(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, upd tgbotapi.Update) error {
+		from := upd.SentFrom()
+		if from == nil {
+			return nil
+		}
+		return next(context.WithValue(ctx, "person", from.ID), upd)
+	}
+}
+
+// rateLimiter counts updates of every person in fixed windows
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[int64]rateWindowState
+}
+
+type rateWindowState struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[int64]rateWindowState),
+	}
+}
+
+// Allow counts the update of the person and reports whether it can be handled.
+// The second value is true only for the first rejected update in the window
+func (rl *rateLimiter) Allow(personID int64) (allowed bool, first bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	w := rl.windows[personID]
+	if now.Sub(w.start) >= rl.window {
+		w = rateWindowState{start: now}
+	}
+	w.count++
+	rl.windows[personID] = w
+
+	if len(rl.windows) > 10000 {
+		// Forget people whose windows are over
+		for id, w := range rl.windows {
+			if now.Sub(w.start) >= rl.window {
+				delete(rl.windows, id)
+			}
+		}
+	}
+
+	return w.count <= rl.limit, w.count == rl.limit+1
+}
+
+// rateLimitMiddleware drops updates of people who send too many of them.
+// It needs the person in the context, so it goes after userMiddleware
+func rateLimitMiddleware(rl *rateLimiter) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, upd tgbotapi.Update) error {
+			pid, ok := ctx.Value("person").(int64)
+			if !ok {
+				return next(ctx, upd)
+			}
+			allowed, first := rl.Allow(pid)
+			if allowed {
+				return next(ctx, upd)
+			}
+
+			logger.Warn("Rate limit is exceeded", zap.Int64("personid", pid), zap.String("route", routeName(ctx)))
+			switch {
+			case upd.CallbackQuery != nil:
+				callbackAnswer(upd.CallbackQuery.ID, "Too many requests. Wait a minute.")
+			case upd.Message != nil && first:
+				// Only the first time, so the bot doesn't spam
+				botSend(tgbotapi.NewMessage(upd.Message.Chat.ID, "Too many requests. Wait a minute."))
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
+)
+
+// Prefixes of keys where settings were kept before the settings hash
+var legacySettingsKeys = []string{"plist", "wordsn", "sep", "wbits", "trans", "policy", "bip39", "ttl", "gdm"}
+
+// Number of times the chat is migrated again if another replica changes it at the same time
+const migrateAttempts = 10
+
+var ErrMigrationConflict = errors.New("Settings are changed by somebody else during the migration")
+
+// migrateSettings moves settings from separate keys into the settings hash of
+// every chat, so people keep their settings after the update. It's run at the
+// start and does nothing if there is nothing to move. Several replicas
+// can run it together, the result is the same
+func migrateSettings(conn RedisConn) error {
+	ids := make(map[int64]struct{})
+	for _, prefix := range legacySettingsKeys {
+		keys, err := scanKeys(conn, prefix+":*")
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			id, err := strconv.ParseInt(strings.TrimPrefix(key, prefix+":"), 10, 64)
+			if err != nil || id == 0 {
+				continue
+			}
+			ids[id] = struct{}{}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	for id := range ids {
+		if err := migrateChatSettings(conn, id); err != nil {
+			return err
+		}
+	}
+	logger.Info("Migrated settings", zap.Int("chats", len(ids)))
+	return nil
+}
+
+// migrateChatSettings saves settings of the chat into the hash and deletes the old keys.
+// The hash isn't replaced if it already exists. The keys are watched, so if another
+// replica migrates the chat at the same time, the chat is checked again
+func migrateChatSettings(conn RedisConn, chatID int64) error {
+	key := fmt.Sprintf("settings:%d", chatID)
+	legacy := make([]interface{}, 0, len(legacySettingsKeys))
+	for _, prefix := range legacySettingsKeys {
+		legacy = append(legacy, fmt.Sprintf("%s:%d", prefix, chatID))
+	}
+
+	for i := 0; i < migrateAttempts; i++ {
+		done, err := tryMigrateChatSettings(conn, chatID, key, legacy)
+		if err != nil || done {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: chat %d", ErrMigrationConflict, chatID)
+}
+
+// tryMigrateChatSettings runs one attempt of the migration of the chat.
+// false is returned if the keys were changed by somebody else
+func tryMigrateChatSettings(conn RedisConn, chatID int64, key string, legacy []interface{}) (bool, error) {
+	if _, err := conn.do("WATCH", append([]interface{}{key}, legacy...)...); err != nil {
+		return false, err
+	}
+	// Nothing is watched after EXEC, it's for the returns before it
+	defer conn.do("UNWATCH")
+
+	exists, err := redis.Bool(conn.do("EXISTS", key))
+	if err != nil {
+		return false, err
+	}
+
+	t := conn.NewRedisTransaction()
+	if !exists {
+		s, err := legacySettings(conn, chatID)
+		if err != nil {
+			return false, err
+		}
+		if err := s.Validate(); err != nil {
+			logger.Warn("Invalid settings are reset", zap.Error(err), zap.Int64("chatid", chatID))
+			s = resetSettings(s)
+		}
+		t.Cmd("HSET", redis.Args{}.Add(key).AddFlat(&s)...).
+			Cmd("EXPIRE", key, int(settingsTTL.Seconds()))
+	}
+	_, err = t.Cmd("DEL", legacy...).Exec(conn.Context())
+	if err == redis.ErrNil {
+		// EXEC is aborted, one of the watched keys is changed
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// legacySettings reads settings of the chat from separate keys
+func legacySettings(conn RedisConn, chatID int64) (Settings, error) {
+	s := defaultSettings()
+	rg := conn.NewRedisGetRequest().ID(chatID)
+
+	wl, err := rg.GetPersonList()
+	switch {
+	case err == nil:
+		s.Wordlist = wl
+	case err != redis.ErrNil:
+		return s, err
+	}
+	n, err := rg.GetWordsNumber()
+	switch {
+	case err == nil && n > 0:
+		s.Words = n
+	case err != nil && err != redis.ErrNil:
+		return s, err
+	}
+	sep, err := rg.GetSeparator()
+	switch {
+	case err == nil:
+		s.Separator = sep
+	case err != redis.ErrNil:
+		return s, err
+	}
+
+	if s.TargetBits, err = rg.GetTargetEntropy(); err != nil {
+		return s, err
+	}
+	if s.Transform, err = rg.GetTransforms(); err != nil {
+		return s, err
+	}
+	if s.PolicyID, err = rg.GetPolicyID(); err != nil {
+		return s, err
+	}
+	if s.Mnemonic, err = rg.GetMnemonicWords(); err != nil {
+		return s, err
+	}
+	if s.SelfDestruct, err = rg.GetSelfDestruct(); err != nil {
+		return s, err
+	}
+	if s.PrivateDelivery, err = rg.GetPrivateDelivery(); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// scanKeys returns keys that match the pattern. SCAN doesn't block Redis like KEYS
+func scanKeys(conn RedisConn, pattern string) ([]string, error) {
+	var keys []string
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		if cursor, err = redis.Int(values[0], nil); err != nil {
+			return nil, err
+		}
+		page, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingStore keeps values that wait for the next message of the person,
+// for example a passphrase that waits for the encryption password.
+// Values are kept only in the memory of the process, so secrets
+// never get into the database
+type pendingStore[T any] struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	m   map[int64]pendingValue[T]
+}
+
+type pendingValue[T any] struct {
+	value   T
+	expires time.Time
+}
+
+func newPendingStore[T any](ttl time.Duration) *pendingStore[T] {
+	return &pendingStore[T]{
+		ttl: ttl,
+		m:   make(map[int64]pendingValue[T]),
+	}
+}
+
+// Put stores the value of the person replacing the previous one
+func (ps *pendingStore[T]) Put(personID int64, v T) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.m[personID] = pendingValue[T]{value: v, expires: time.Now().Add(ps.ttl)}
+}
+
+// Take returns and removes the value of the person.
+// false is returned if there is no value or it has expired
+func (ps *pendingStore[T]) Take(personID int64) (v T, ok bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	pv, ok := ps.m[personID]
+	delete(ps.m, personID)
+	if !ok || time.Now().After(pv.expires) {
+		return v, false
+	}
+	return pv.value, true
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	policyAttempts = 100000 // Maximal number of passphrases generated to satisfy the policy
+	policyMinFit   = 1e-3   // Minimal share of passphrases that fit the maximal length
+	policyMaxLen   = 128    // Maximal value of the maximal length of the policy
+	policyMaxUser  = 10     // Maximal number of policies of one person
+	policyNone     = "none" // ID used to turn the policy off
+)
+
+var (
+	ErrPolicyUnsatisfiable = errors.New("Passphrase can't satisfy the policy")
+	ErrPolicyNotFound      = errors.New("Policy is not found")
+	ErrInvalidPolicy       = errors.New("Policy is invalid")
+	ErrTooManyPolicies     = errors.New("Too many policies")
+)
+
+// CharClass is a set of character classes required by the policy
+type CharClass uint8
+
+const (
+	ClassLower CharClass = 1 << iota
+	ClassUpper
+	ClassDigit
+	ClassSymbol
+
+	classAll = ClassLower | ClassUpper | ClassDigit | ClassSymbol
+)
+
+var classNames = []struct {
+	c    CharClass
+	name string
+}{
+	{ClassLower, "lower"},
+	{ClassUpper, "upper"},
+	{ClassDigit, "digit"},
+	{ClassSymbol, "symbol"},
+}
+
+// Policy describes password requirements of a site
+type Policy struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	MaxLen     int       `json:"max_len,omitempty"`    // Maximal length in characters, any if it's 0
+	Require    CharClass `json:"require,omitempty"`    // Classes that have to be in the passphrase
+	Banned     string    `json:"banned,omitempty"`     // Characters that can't be in the passphrase
+	Separators []string  `json:"separators,omitempty"` // Allowed separators, any if it's empty
+}
+
+// Built-in policies of common sites
+var builtinPolicies = []Policy{
+	{ID: "strict", Name: "All classes", Require: classAll},
+	{ID: "max32", Name: "Max 32, upper and digit", MaxLen: 32, Require: ClassUpper | ClassDigit},
+	{ID: "alnum", Name: "Letters and digits only", Require: ClassUpper | ClassDigit, Banned: transSymbols + " ", Separators: []string{""}},
+	{ID: "nospace", Name: "No spaces", Banned: " ", Separators: []string{"-", "_", "."}},
+}
+
+// User's policies are referenced by names, so names are limited to the safe characters
+var policyNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,20}$`)
+
+// builtinPolicy returns the built-in policy with the id
+func builtinPolicy(id string) (Policy, bool) {
+	for _, p := range builtinPolicies {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Policy{}, false
+}
+
+// Describe returns short human-readable description of the policy
+func (p *Policy) Describe() string {
+	var parts []string
+	if p.MaxLen > 0 {
+		parts = append(parts, fmt.Sprintf("max %d characters", p.MaxLen))
+	}
+	if p.Require != 0 {
+		var names []string
+		for _, cn := range classNames {
+			if p.Require&cn.c != 0 {
+				names = append(names, cn.name)
+			}
+		}
+		parts = append(parts, "requires "+strings.Join(names, ", "))
+	}
+	if p.Banned != "" {
+		parts = append(parts, fmt.Sprintf("bans %q", p.Banned))
+	}
+	if len(p.Separators) > 0 {
+		parts = append(parts, fmt.Sprintf("separators %q", p.Separators))
+	}
+	if len(parts) == 0 {
+		return "no restrictions"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Check returns an error if the passphrase breaks the policy
+func (p *Policy) Check(passphrase string) error {
+	if p.MaxLen > 0 && utf8.RuneCountInString(passphrase) > p.MaxLen {
+		return fmt.Errorf("%w: longer than %d characters", ErrPolicyUnsatisfiable, p.MaxLen)
+	}
+	if strings.ContainsAny(passphrase, p.Banned) {
+		return fmt.Errorf("%w: contains banned characters", ErrPolicyUnsatisfiable)
+	}
+	if missing := p.Require &^ charClasses(passphrase); missing != 0 {
+		return fmt.Errorf("%w: misses required characters", ErrPolicyUnsatisfiable)
+	}
+	return nil
+}
+
+// charClasses returns classes of characters that are in s
+func charClasses(s string) (c CharClass) {
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			c |= ClassLower
+		case unicode.IsUpper(r):
+			c |= ClassUpper
+		case unicode.IsDigit(r):
+			c |= ClassDigit
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			c |= ClassSymbol
+		}
+	}
+	return
+}
+
+// genPlan is everything needed to generate the passphrase
+// after the policy is applied to the config
+type genPlan struct {
+	words     []string
+	separator string
+	transform Transform
+	alphabet  transAlphabet
+	policy    *Policy
+	lengths   []float64 // Share of words of every length in characters, used for the maximal length
+}
+
+// plan applies the policy to the config. Words and characters banned by
+// the policy are removed before generation and transformations required
+// by the policy are turned on, so the distribution stays uniform
+func (gpc *GeneratePasswordConfig) plan() (*genPlan, error) {
+	gp := &genPlan{
+		words:     *gpc.list().Words(),
+		separator: gpc.separator,
+		transform: gpc.transform,
+		alphabet:  defAlphabet,
+		policy:    gpc.policy,
+	}
+	p := gpc.policy
+	if p == nil {
+		return gp, nil
+	}
+
+	if p.Require&ClassUpper != 0 && !gp.transform.Has(TransTitle) && !gp.transform.Has(TransUpperWord) {
+		gp.transform |= TransTitle
+	}
+	if p.Require&ClassDigit != 0 {
+		gp.transform |= TransDigit
+	}
+	if p.Require&ClassSymbol != 0 {
+		gp.transform |= TransSymbol
+	}
+
+	gp.alphabet.digits = removeChars(gp.alphabet.digits, p.Banned)
+	gp.alphabet.symbols = removeChars(gp.alphabet.symbols, p.Banned)
+	if p.Require&ClassDigit != 0 && gp.alphabet.digits == "" {
+		return nil, fmt.Errorf("%w: every digit is banned", ErrPolicyUnsatisfiable)
+	}
+	if p.Require&ClassSymbol != 0 && gp.alphabet.symbols == "" {
+		return nil, fmt.Errorf("%w: every symbol is banned", ErrPolicyUnsatisfiable)
+	}
+
+	// Separator of the person is kept if the policy allows it
+	candidates := p.Separators
+	if len(candidates) == 0 {
+		candidates = []string{gpc.separator, "-", "_", ".", ""}
+	}
+	found := false
+	for _, sep := range candidates {
+		if strings.ContainsAny(sep, p.Banned) {
+			continue
+		}
+		if !found || sep == gpc.separator {
+			gp.separator = sep
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: every separator is banned", ErrPolicyUnsatisfiable)
+	}
+
+	if p.Banned != "" {
+		upper := gp.transform.Has(TransTitle) || gp.transform.Has(TransUpperWord)
+		words := make([]string, 0, len(gp.words))
+		for _, w := range gp.words {
+			if strings.ContainsAny(w, p.Banned) || upper && strings.ContainsAny(strings.ToUpper(w), p.Banned) {
+				continue
+			}
+			words = append(words, w)
+		}
+		gp.words = words
+	}
+	if len(gp.words) < 2 {
+		return nil, fmt.Errorf("%w: banned characters remove almost every word of the wordlist", ErrPolicyUnsatisfiable)
+	}
+
+	if p.MaxLen > 0 {
+		gp.lengths = make([]float64, userListMaxWord+1)
+		for _, w := range gp.words {
+			if l := utf8.RuneCountInString(w); l < len(gp.lengths) {
+				gp.lengths[l] += 1 / float64(len(gp.words))
+			}
+		}
+	}
+
+	return gp, nil
+}
+
+// removeChars returns s without characters of banned
+func removeChars(s, banned string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(banned, r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// fit returns share of passphrases of n words that fit the maximal length
+func (gp *genPlan) fit(n int) float64 {
+	if gp.policy == nil || gp.policy.MaxLen == 0 {
+		return 1
+	}
+
+	budget := gp.policy.MaxLen - (n-1)*utf8.RuneCountInString(gp.separator)
+	if gp.transform.Has(TransDigit) {
+		budget--
+	}
+	if gp.transform.Has(TransSymbol) {
+		budget--
+	}
+	if budget < n {
+		return 0
+	}
+
+	// f[s] is the probability that the words have s characters in total
+	f := make([]float64, budget+1)
+	f[0] = 1
+	for k := 0; k < n; k++ {
+		g := make([]float64, budget+1)
+		for s, ps := range f {
+			if ps == 0 {
+				continue
+			}
+			for l, pl := range gp.lengths {
+				if pl == 0 || s+l > budget {
+					continue
+				}
+				g[s+l] += ps * pl
+			}
+		}
+		f = g
+	}
+
+	var sum float64
+	for _, ps := range f {
+		sum += ps
+	}
+	return sum
+}
+
+// bits returns entropy in bits of the passphrase of n words
+func (gp *genPlan) bits(n int) float64 {
+	fit := gp.fit(n)
+	if fit == 0 {
+		return 0
+	}
+	return float64(n)*math.Log2(float64(len(gp.words))) + math.Log2(fit) + gp.transform.Bits(n, gp.alphabet)
+}
+
+// generate returns the passphrase of n words. Passphrases that break the policy
+// are thrown away, so the accepted ones stay uniformly distributed
+func (gp *genPlan) generate(n int) (string, error) {
+	if fit := gp.fit(n); fit < policyMinFit {
+		return " ", fmt.Errorf("%w: %d words of this wordlist rarely fit in %d characters, use fewer words or a wordlist with shorter words", ErrPolicyUnsatisfiable, n, gp.policy.MaxLen)
+	}
+
+	for i := 0; i < policyAttempts; i++ {
+		parts := make([]string, 0, n)
+		for j := 0; j < n; j++ {
+			rnd, err := randInt(len(gp.words))
+			if err != nil {
+				return " ", err
+			}
+			parts = append(parts, gp.words[rnd])
+		}
+
+		if err := gp.transform.Apply(parts, gp.alphabet); err != nil {
+			return " ", err
+		}
+
+		passphrase := strings.Join(parts, gp.separator)
+		if gp.policy == nil || gp.policy.Check(passphrase) == nil {
+			return passphrase, nil
+		}
+	}
+
+	return " ", fmt.Errorf("%w: too few passphrases fit it, try another wordlist or number of words", ErrPolicyUnsatisfiable)
+}
+
+// parsePolicy parses arguments of /addpolicy command:
+// name [max=N] [require=upper,lower,digit,symbol] [banned=CHARS] [sep=CHARS|none]
+func parsePolicy(args string) (Policy, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return Policy{}, fmt.Errorf("%w: name is missing", ErrInvalidPolicy)
+	}
+
+	p := Policy{ID: fields[0], Name: fields[0]}
+	if !policyNamePattern.MatchString(p.ID) {
+		return p, fmt.Errorf("%w: name has to be up to 20 latin letters, digits, _ or -", ErrInvalidPolicy)
+	}
+	if _, ok := builtinPolicy(p.ID); ok || p.ID == policyNone {
+		return p, fmt.Errorf("%w: name %s is reserved", ErrInvalidPolicy, p.ID)
+	}
+
+	for _, f := range fields[1:] {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok || value == "" {
+			return p, fmt.Errorf("%w: %q has to look like key=value", ErrInvalidPolicy, f)
+		}
+
+		switch key {
+		case "max":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > policyMaxLen {
+				return p, fmt.Errorf("%w: max has to be a number from 1 to %d", ErrInvalidPolicy, policyMaxLen)
+			}
+			p.MaxLen = n
+		case "require":
+		Classes:
+			for _, name := range strings.Split(value, ",") {
+				for _, cn := range classNames {
+					if cn.name == name {
+						p.Require |= cn.c
+						continue Classes
+					}
+				}
+				return p, fmt.Errorf("%w: unknown class %q", ErrInvalidPolicy, name)
+			}
+		case "banned":
+			p.Banned = value
+		case "sep":
+			if value == "none" {
+				p.Separators = []string{""}
+				continue
+			}
+			for _, r := range value {
+				p.Separators = append(p.Separators, string(r))
+			}
+		default:
+			return p, fmt.Errorf("%w: unknown option %q", ErrInvalidPolicy, key)
+		}
+	}
+
+	return p, nil
+}
+
+// personPolicy returns the policy with the ID chosen by the person or nil if there is none
+func personPolicy(ctx context.Context, st Storage, personID int64, id string) (*Policy, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	if p, ok := builtinPolicy(id); ok {
+		return &p, nil
+	}
+	p, err := st.UserPolicy(ctx, personID, id)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// policyMessage returns text and keyboard of /policy command
+func policyMessage(ctx context.Context, st Storage, chatID int64) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	s, err := st.Settings(ctx, chatID)
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, err
+	}
+	current, err := personPolicy(ctx, st, chatID, s.PolicyID)
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, err
+	}
+	own, err := st.UserPolicies(ctx, chatID)
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<b>Site policy</b>\n\nThe policy shapes every new passphrase: length, required characters, banned characters and separators.\n\n")
+	if current == nil {
+		sb.WriteString("Current policy: <b>none</b>")
+	} else {
+		sb.WriteString(fmt.Sprintf("Current policy: <b>%s</b> (%s)", tgbotapi.EscapeText(tgbotapi.ModeHTML, current.Name), tgbotapi.EscapeText(tgbotapi.ModeHTML, current.Describe())))
+	}
+	sb.WriteString("\n\nAdd your own with\n<code>/addpolicy name max=32 require=upper,digit banned=#% sep=-_</code>\nand delete it with <code>/delpolicy name</code>")
+
+	return sb.String(), IKBPolicies(builtinPolicies, own, current), nil
+}
+
+// handlePolicyCallback sets the policy chosen with the /policy keyboard
+func handlePolicyCallback(ctx context.Context, cq *tgbotapi.CallbackQuery, id string) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		return ErrCantParseCtx
+	}
+
+	chatID := cq.Message.Chat.ID
+	if !canChangeChatSettings(cq) {
+		callbackAnswer(cq.ID, ErrNotChatAdmin.Error())
+		return nil
+	}
+
+	policyID := id
+	if id == policyNone {
+		policyID = ""
+	} else if _, ok := builtinPolicy(id); !ok {
+		if _, err := st.UserPolicy(ctx, chatID, id); err != nil {
+			return err
+		}
+	}
+	if err := updateSettings(ctx, st, chatID, func(s *Settings) { s.PolicyID = policyID }); err != nil {
+		return err
+	}
+
+	text, ikb, err := policyMessage(ctx, st, chatID)
+	if err != nil {
+		return err
+	}
+	ec := tgbotapi.NewEditMessageTextAndMarkup(chatID, cq.Message.MessageID, text, ikb)
+	ec.ParseMode = tgbotapi.ModeHTML
+	if _, err := bot.Request(ec); err != nil {
+		return err
+	}
+
+	callbackAnswer(cq.ID, "Policy is changed")
+	logger.Info("Changed policy of chat", zap.Int64("chatid", chatID), zap.String("policy", id))
+	return nil
+}
+
+// handleAddPolicyCommand saves the policy of the person and selects it
+func handleAddPolicyCommand(ctx context.Context, st Storage, personID int64, args string) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	p, err := parsePolicy(args)
+	if err != nil {
+		msg.Text = fmt.Sprintf("%s\n\nFor example:\n<code>/addpolicy bank max=20 require=upper,digit banned=&lt;&gt; sep=-_</code>", tgbotapi.EscapeText(tgbotapi.ModeHTML, err.Error()))
+		msg.ParseMode = tgbotapi.ModeHTML
+		return
+	}
+
+	if err := st.SaveUserPolicy(ctx, personID, p); err != nil {
+		if errors.Is(err, ErrTooManyPolicies) {
+			msg.Text = fmt.Sprintf("You can have up to %d policies. Delete one with /delpolicy", policyMaxUser)
+			return
+		}
+		logger.Error("Can't save policy", zap.Error(err), zap.Int64("personid", personID))
+		msg.Text = "Can't save the policy. Sorry."
+		return
+	}
+	if err := updateSettings(ctx, st, personID, func(s *Settings) { s.PolicyID = p.ID }); err != nil {
+		logger.Error("Can't set policy", zap.Error(err), zap.Int64("personid", personID))
+	}
+
+	msg.Text = fmt.Sprintf("Policy <b>%s</b> (%s) is saved and selected.", tgbotapi.EscapeText(tgbotapi.ModeHTML, p.Name), tgbotapi.EscapeText(tgbotapi.ModeHTML, p.Describe()))
+	msg.ParseMode = tgbotapi.ModeHTML
+	return
+}
+
+// handleDelPolicyCommand deletes the policy of the person
+func handleDelPolicyCommand(ctx context.Context, st Storage, personID int64, name string) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		msg.Text = "Type the name of the policy after the command, for example:\n<code>/delpolicy bank</code>"
+		msg.ParseMode = tgbotapi.ModeHTML
+		return
+	}
+
+	if err := st.DeleteUserPolicy(ctx, personID, name); err != nil {
+		if errors.Is(err, ErrPolicyNotFound) {
+			msg.Text = "You don't have such a policy. See your policies with /policy"
+			return
+		}
+		logger.Error("Can't delete policy", zap.Error(err), zap.Int64("personid", personID))
+		msg.Text = "Can't delete the policy. Sorry."
+		return
+	}
+
+	msg.Text = "Policy is deleted."
+	return
+}
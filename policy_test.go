@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// testWordlist returns a filled wordlist with the words
+func testWordlist(words ...string) *Wordlist {
+	return &Wordlist{id: userwl, size: len(words), words: &words}
+}
+
+// Words of 2 and 4 characters, so the share of fitting passphrases is easy to count
+func shortLongConfig(p *Policy) *GeneratePasswordConfig {
+	return NewGeneratePasswordConfig().
+		UserWordlist(testWordlist("ab", "abcd")).
+		Separator("-").
+		Length(3).
+		Policy(p)
+}
+
+func TestPolicyPlan(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Policy
+		fit    float64
+		bits   float64 // Entropy of 3 words
+	}{
+		{
+			name: "no policy",
+			fit:  1,
+			bits: 3,
+		},
+		{
+			name:   "always fits",
+			policy: &Policy{MaxLen: 20},
+			fit:    1,
+			bits:   3,
+		},
+		{
+			// 3 words and 2 separators fit in 12 characters unless every word is long
+			name:   "sometimes fits",
+			policy: &Policy{MaxLen: 12},
+			fit:    7.0 / 8,
+			bits:   3 + math.Log2(7.0/8),
+		},
+		{
+			// The digit takes one character and can be after any of 10 digits and 3 words
+			name:   "sometimes fits with a digit",
+			policy: &Policy{MaxLen: 13, Require: ClassDigit},
+			fit:    7.0 / 8,
+			bits:   3 + math.Log2(7.0/8) + math.Log2(30),
+		},
+		{
+			name:   "never fits",
+			policy: &Policy{MaxLen: 7},
+			fit:    0,
+			bits:   0,
+		},
+	}
+	for _, tt := range tests {
+		gp, err := shortLongConfig(tt.policy).plan()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := gp.fit(3); math.Abs(got-tt.fit) > 1e-9 {
+			t.Errorf("%s: got fit %v, want %v", tt.name, got, tt.fit)
+		}
+		if got := gp.bits(3); math.Abs(got-tt.bits) > 1e-9 {
+			t.Errorf("%s: got %v bits, want %v", tt.name, got, tt.bits)
+		}
+	}
+}
+
+func TestPolicyGenerate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Policy
+		err    error
+	}{
+		{name: "always fits", policy: &Policy{MaxLen: 20, Require: ClassUpper | ClassDigit}},
+		{name: "sometimes fits", policy: &Policy{MaxLen: 12}},
+		{name: "every class", policy: &Policy{MaxLen: 14, Require: classAll, Banned: "#$%"}},
+		{name: "allowed separator", policy: &Policy{Separators: []string{"."}}},
+		{name: "never fits", policy: &Policy{MaxLen: 7}, err: ErrPolicyUnsatisfiable},
+	}
+	for _, tt := range tests {
+		gpc := shortLongConfig(tt.policy)
+		for i := 0; i < 100; i++ {
+			passphrase, err := gpc.Generate()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("%s: got %v, want %v", tt.name, err, tt.err)
+			}
+			if err != nil {
+				break
+			}
+			if err := tt.policy.Check(passphrase); err != nil {
+				t.Fatalf("%s: %q: %v", tt.name, passphrase, err)
+			}
+			if n := utf8.RuneCountInString(passphrase); tt.policy.MaxLen > 0 && n > tt.policy.MaxLen {
+				t.Fatalf("%s: %q has %d characters", tt.name, passphrase, n)
+			}
+			if len(tt.policy.Separators) > 0 && strings.Count(passphrase, tt.policy.Separators[0]) < 2 {
+				t.Fatalf("%s: %q doesn't use the separator", tt.name, passphrase)
+			}
+		}
+	}
+}
+
+func TestPolicyUnsatisfiable(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Policy
+	}{
+		{"every digit is banned", &Policy{Require: ClassDigit, Banned: defAlphabet.digits}},
+		{"every symbol is banned", &Policy{Require: ClassSymbol, Banned: transSymbols}},
+		{"every separator is banned", &Policy{Separators: []string{"-"}, Banned: "-"}},
+		{"every word is banned", &Policy{Banned: "a"}},
+	}
+	for _, tt := range tests {
+		gpc := shortLongConfig(tt.policy)
+		if _, err := gpc.plan(); !errors.Is(err, ErrPolicyUnsatisfiable) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if _, err := gpc.Generate(); !errors.Is(err, ErrPolicyUnsatisfiable) {
+			t.Errorf("%s: generated with %v", tt.name, err)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	p := Policy{MaxLen: 10, Require: ClassUpper | ClassDigit, Banned: " "}
+	tests := []struct {
+		passphrase string
+		ok         bool
+	}{
+		{"Ab-cd1", true},
+		{"Ab-cd-ef-1", true},
+		{"Ab-cd-efg-1", false},
+		{"ab-cd1", false},
+		{"Ab-cd", false},
+		{"Ab cd1", false},
+	}
+	for _, tt := range tests {
+		if err := p.Check(tt.passphrase); (err == nil) != tt.ok {
+			t.Errorf("%q: got %v", tt.passphrase, err)
+		}
+	}
+}
@@ -2,30 +2,114 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
 )
 
+// Time of one operation of Redis. A stuck Redis fails the update
+// after it instead of holding the worker
+const redisTimeout = 3 * time.Second
+
 type RedisConn struct {
-	conn redis.Conn
+	conn   redis.Conn      // nil if the bot runs without Redis
+	ctx    context.Context // Operations are cancelled with it, see WithContext
+	failed *atomic.Value   // Error the person has to know about, see Failure
 }
 
+// NewConn takes the connection from the pool. Without the pool the connection
+// works too, but its operations fail with ErrNoRedis
 func NewConn(pool *redis.Pool) RedisConn {
 	return func() RedisConn {
-		return RedisConn{
-			conn: pool.Get(),
+		c := RedisConn{
+			failed: new(atomic.Value),
+		}
+		if pool != nil {
+			c.conn = pool.Get()
 		}
+		return c
 	}()
 }
 
 func (c RedisConn) Close() {
-	c.conn.Close()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// WithContext returns the connection whose operations are cancelled with ctx,
+// usually the context of the update
+func (c RedisConn) WithContext(ctx context.Context) RedisConn {
+	c.ctx = ctx
+	return c
+}
+
+// Context of operations of the connection
+func (c RedisConn) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// Failure returns ErrRedisTimeout if an operation has run out of time
+// and ErrNoRedis if an operation was run without Redis, nil otherwise.
+// The connection is broken after the timeout and the pool doesn't reuse it
+func (c RedisConn) Failure() error {
+	if c.failed == nil {
+		return nil
+	}
+	err, _ := c.failed.Load().(error)
+	return err
+}
+
+// fail remembers the first failure of the connection
+func (c RedisConn) fail(err error) {
+	if c.failed != nil {
+		c.failed.CompareAndSwap(nil, err)
+	}
+}
+
+// available returns ErrNoRedis if the bot runs without Redis
+func (c RedisConn) available() error {
+	if c.conn == nil {
+		c.fail(ErrNoRedis)
+		return ErrNoRedis
+	}
+	return nil
+}
+
+// checkTimeout turns the error of the operation that has run out of time into ErrRedisTimeout
+func (c RedisConn) checkTimeout(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	var ne net.Error
+	if ctx.Err() == nil && !(errors.As(err, &ne) && ne.Timeout()) {
+		return err
+	}
+	c.fail(ErrRedisTimeout)
+	return fmt.Errorf("%w: %v", ErrRedisTimeout, err)
 }
 
+var (
+	ErrNoCommand    = errors.New("Command of the request is empty")
+	ErrRedisTimeout = errors.New("Redis doesn't answer in time")
+	ErrNoRedis      = errors.New("The bot runs without Redis")
+)
+
+// RedisRequest runs any command of Redis, so new features don't need
+// their own request struct:
+//
+//	n, err := conn.NewRedisRequest().Command("HLEN").Params([]interface{}{key}).GetInt(ctx)
 type RedisRequest struct {
 	conn       RedisConn
 	command    string
@@ -42,7 +126,19 @@ func (r RedisConn) NewRedisRequest() *RedisRequest {
 }
 
 func (r RedisConn) do(commandName string, args ...interface{}) (reply interface{}, err error) {
-	return r.conn.Do(commandName, args...)
+	return r.doContext(r.Context(), commandName, args...)
+}
+
+// doContext runs the command. It fails with ErrRedisTimeout when ctx
+// is cancelled or Redis doesn't answer in redisTimeout
+func (r RedisConn) doContext(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	if err := r.available(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	reply, err = redis.DoContext(r.conn, ctx, commandName, args...)
+	return reply, r.checkTimeout(ctx, err)
 }
 
 func (r RedisConn) doInt(commandName string, args ...interface{}) (reply int, err error) {
@@ -61,31 +157,152 @@ func (r RedisConn) doString(commandName string, args ...interface{}) (reply stri
 }
 
 // Change command of the redis request struct
-func (r *RedisRequest) Command(c string) {
-
+func (r *RedisRequest) Command(c string) *RedisRequest {
+	r.command = c
+	return r
 }
 
 // Add params into redis request struct
-func (r *RedisRequest) Params(p []interface{}) {
-
+func (r *RedisRequest) Params(p []interface{}) *RedisRequest {
+	r.params = append(r.params, p...)
+	return r
 }
 
-// Set wantResult value into redis request struct
-func (r *RedisRequest) WantResult(w bool) {
+// Set wantResult value into redis request struct. Replies of requests
+// that don't want the result are dropped, only errors are returned
+func (r *RedisRequest) WantResult(w bool) *RedisRequest {
+	r.wantResult = w
+	return r
+}
 
+// Do runs the request and returns the raw reply
+func (r *RedisRequest) Do(ctx context.Context) (interface{}, error) {
+	if r.command == "" {
+		return nil, ErrNoCommand
+	}
+	reply, err := r.conn.doContext(ctx, r.command, r.params...)
+	if !r.wantResult {
+		return nil, err
+	}
+	return reply, err
 }
 
 func (r *RedisRequest) GetBool(ctx context.Context) (bool, error) {
-	panic("Not implemented")
+	return redis.Bool(r.WantResult(true).Do(ctx))
+}
+
+func (r *RedisRequest) GetInt(ctx context.Context) (int, error) {
+	return redis.Int(r.WantResult(true).Do(ctx))
+}
+
+func (r *RedisRequest) GetString(ctx context.Context) (string, error) {
+	return redis.String(r.WantResult(true).Do(ctx))
+}
+
+func (r *RedisRequest) GetStringSlice(ctx context.Context) ([]string, error) {
+	return redis.Strings(r.WantResult(true).Do(ctx))
+}
+
+// RedisPipeline sends several requests at once and reads
+// their replies after that, so they take one round trip
+type RedisPipeline struct {
+	conn     RedisConn
+	requests []*RedisRequest
+	multi    bool
 }
-func (r *RedisRequest) GetInt(ctx context.Context) (bool, error) {
-	panic("Not implemented")
+
+func (r RedisConn) NewRedisPipeline() *RedisPipeline {
+	return &RedisPipeline{conn: r}
 }
-func (r *RedisRequest) GetString(ctx context.Context) (bool, error) {
-	panic("Not implemented")
+
+// NewRedisTransaction returns the pipeline that runs its requests
+// in MULTI/EXEC, so other clients never see them done partly
+func (r RedisConn) NewRedisTransaction() *RedisPipeline {
+	return &RedisPipeline{conn: r, multi: true}
 }
-func (r *RedisRequest) GetStringSlice(ctx context.Context) (bool, error) {
-	panic("Not implemented")
+
+// Add requests to the pipeline. They are run with the connection of the pipeline
+func (p *RedisPipeline) Add(reqs ...*RedisRequest) *RedisPipeline {
+	p.requests = append(p.requests, reqs...)
+	return p
+}
+
+// Cmd adds the command whose reply is wanted
+func (p *RedisPipeline) Cmd(command string, params ...interface{}) *RedisPipeline {
+	return p.Add(p.conn.NewRedisRequest().Command(command).Params(params).WantResult(true))
+}
+
+// Exec runs the requests and returns their replies in the same order,
+// nil for requests that don't want the result. If some requests fail,
+// replies of the others are returned with the first error
+func (p *RedisPipeline) Exec(ctx context.Context) ([]interface{}, error) {
+	for _, r := range p.requests {
+		if r.command == "" {
+			return nil, ErrNoCommand
+		}
+	}
+	if len(p.requests) == 0 {
+		return nil, nil
+	}
+	if err := p.conn.available(); err != nil {
+		return nil, err
+	}
+
+	// The deadline is for the whole pipeline, it takes one round trip
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	replies, err := p.exec(ctx)
+	return replies, p.conn.checkTimeout(ctx, err)
+}
+
+func (p *RedisPipeline) exec(ctx context.Context) ([]interface{}, error) {
+	c := p.conn.conn
+	if p.multi {
+		if err := c.Send("MULTI"); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range p.requests {
+		if err := c.Send(r.command, r.params...); err != nil {
+			return nil, err
+		}
+	}
+
+	var replies []interface{}
+	var first error
+	if p.multi {
+		// Do reads replies of MULTI and queued commands, EXEC returns replies of all commands
+		var err error
+		replies, err = redis.Values(redis.DoContext(c, ctx, "EXEC"))
+		if err != nil {
+			return nil, err
+		}
+		for _, reply := range replies {
+			if err, ok := reply.(redis.Error); ok && first == nil {
+				first = err
+			}
+		}
+	} else {
+		if err := c.Flush(); err != nil {
+			return nil, err
+		}
+		// Every reply is read even after errors, so the connection stays in sync
+		replies = make([]interface{}, len(p.requests))
+		for i := range p.requests {
+			reply, err := redis.ReceiveContext(c, ctx)
+			if err != nil && first == nil {
+				first = err
+			}
+			replies[i] = reply
+		}
+	}
+
+	for i, r := range p.requests {
+		if !r.wantResult {
+			replies[i] = nil
+		}
+	}
+	return replies, first
 }
 
 type RedisSetRequest struct {
@@ -131,7 +348,7 @@ func (r *RedisSetRequest) ExpireAt(t time.Time) *RedisSetRequest {
 func (r *RedisSetRequest) Set(ctx context.Context) error {
 	// Without expiration
 	if r.expireInSec == 0 && r.expireAt.IsZero() {
-		_, err := r.conn.do("SET", r.key, r.value)
+		_, err := r.conn.doContext(ctx, "SET", r.key, r.value)
 		return err
 	}
 
@@ -151,22 +368,24 @@ func (r *RedisSetRequest) Set(ctx context.Context) error {
 		return errors.New("Expiration time is less than zero")
 	}
 
-	_, err := r.conn.do("SETEX", r.key, s, r.value)
+	_, err := r.conn.doContext(ctx, "SETEX", r.key, s, r.value)
 	return err
 }
 
-// Set desired wordlist of a person to the cache
-func (r *RedisSetRequest) SetPersonList(PersonID int64, ListID WL) error {
-	if PersonID == 0 {
-		return errors.New("Invalid person's or list's ID")
-	}
-	if ListID >= endofwl || ListID < 0 {
-		return errors.New("ListID is invalid")
+// Replace settings of the chat. All settings are kept in one hash and
+// written in one transaction, so they are never saved partly
+func (r *RedisSetRequest) SetSettings(ChatID int64, s Settings) error {
+	if ChatID == 0 {
+		return errors.New("Invalid chat's ID")
 	}
 
-	r.key = fmt.Sprintf("plist:%d", PersonID)
-	r.value = ListID
-	return r.Set(context.Background()) // TODO: use context in the future
+	key := fmt.Sprintf("settings:%d", ChatID)
+	_, err := r.conn.NewRedisTransaction().
+		Cmd("DEL", key). // Fields of older versions aren't left
+		Cmd("HSET", redis.Args{}.Add(key).AddFlat(&s)...).
+		Cmd("EXPIRE", key, int(settingsTTL.Seconds())).
+		Exec(r.conn.Context())
+	return err
 }
 
 // Set last action of a person to the cache
@@ -177,32 +396,133 @@ func (r *RedisSetRequest) SetLastAction(PersonID int64, action LastAction) error
 
 	r.key = fmt.Sprintf("lastact:%d", PersonID)
 	r.value = action
-	r.expireInSec = 3600               // one hour for making an action
-	return r.Set(context.Background()) // TODO: use context in the future
+	r.expireInSec = 3600 // one hour for making an action
+	return r.Set(r.conn.Context())
+}
+
+// Add or replace policy defined by the person
+func (r *RedisSetRequest) SetUserPolicy(PersonID int64, p Policy) error {
+	if PersonID == 0 {
+		return errors.New("Invalid person's ID")
+	}
+
+	key := fmt.Sprintf("policies:%d", PersonID)
+	exists, err := redis.Bool(r.conn.do("HEXISTS", key, p.ID))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		n, err := r.conn.doInt("HLEN", key)
+		if err != nil {
+			return err
+		}
+		if n >= policyMaxUser {
+			return ErrTooManyPolicies
+		}
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.conn.do("HSET", key, p.ID, data)
+	return err
+}
+
+// Schedule deletion of the message. Scheduled deletions are kept
+// in the sorted set with the time of deletion as the score
+func (r *RedisSetRequest) ScheduleDeletion(d ScheduledDeletion, at time.Time) error {
+	_, err := r.conn.do("ZADD", "selfdestruct", at.Unix(), d.String())
+	return err
+}
+
+// Set argument of the last action of a person (for example, ID of the vault entry)
+func (r *RedisSetRequest) SetLastActionArg(PersonID int64, arg string) error {
+	if PersonID == 0 {
+		return errors.New("Invalid person's ID")
+	}
+
+	r.key = fmt.Sprintf("lastarg:%d", PersonID)
+	r.value = arg
+	r.expireInSec = 3600 // the same time as for the last action
+	return r.Set(r.conn.Context())
+}
+
+// Get ID for the new entry in the vault of the person
+func (r *RedisSetRequest) NextVaultID(PersonID int64) (int64, error) {
+	if PersonID == 0 {
+		return 0, errors.New("Invalid person's ID")
+	}
+
+	return r.conn.doInt64("INCR", fmt.Sprintf("vseq:%d", PersonID))
+}
+
+// Add or replace encrypted entry in the vault of the person
+func (r *RedisSetRequest) SetVaultEntry(PersonID int64, e VaultEntry) error {
+	if PersonID == 0 {
+		return errors.New("Invalid person's ID")
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.conn.do("HSET", fmt.Sprintf("vault:%d", PersonID), e.ID, data)
+	return err
+}
+
+// Replace salt, password verifier and all entries of the vault
+// of the person in one transaction
+func (r *RedisSetRequest) ReplaceVault(PersonID int64, salt []byte, verifier []byte, entries []VaultEntry) error {
+	if PersonID == 0 {
+		return errors.New("Invalid person's ID")
+	}
+
+	vaultKey := fmt.Sprintf("vault:%d", PersonID)
+	t := r.conn.NewRedisTransaction().
+		Cmd("SET", fmt.Sprintf("vsalt:%d", PersonID), salt).
+		Cmd("SET", fmt.Sprintf("encver:%d", PersonID), verifier).
+		Cmd("DEL", vaultKey)
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		t.Cmd("HSET", vaultKey, e.ID, data)
+	}
+	_, err := t.Exec(r.conn.Context())
+	return err
 }
 
-// Set number of words in the generated passwords for the person
-func (r *RedisSetRequest) SetNumberOfWords(PersonID int64, n int) error {
+// Mark the vault of the person as unlocked for the duration d.
+// Only the flag is stored, the key stays in the memory of the bot
+func (r *RedisSetRequest) SetUnlocked(PersonID int64, d time.Duration) error {
 	if PersonID == 0 {
 		return errors.New("Invalid person's ID")
 	}
 
-	r.key = fmt.Sprintf("wordsn:%d", PersonID)
-	r.value = n
-	r.expireAt = time.Now().Add(365 * 24 * time.Hour) // To free some memory after a year
-	return r.Set(context.Background())                // TODO: use context in the future
+	r.key = fmt.Sprintf("unlocked:%d", PersonID)
+	r.value = 1
+	r.expireInSec = int(d.Seconds())
+	return r.Set(r.conn.Context())
 }
 
-// Set separator for the generated passwords for the person
-func (r *RedisSetRequest) SetSeparator(PersonID int64, s string) error {
+// Set wordlist uploaded by the person. It replaces the previous one
+func (r *RedisSetRequest) SetUserList(PersonID int64, ul UserWordlist) error {
 	if PersonID == 0 {
 		return errors.New("Invalid person's ID")
 	}
 
-	r.key = fmt.Sprintf("sep:%d", PersonID)
-	r.value = s
-	r.expireAt = time.Now().Add(365 * 24 * time.Hour) // To free some memory after a year
-	return r.Set(context.Background())                // TODO: use context in the future
+	data, err := json.Marshal(ul)
+	if err != nil {
+		return err
+	}
+
+	r.key = fmt.Sprintf("ulist:%d", PersonID)
+	r.value = data
+	return r.Set(r.conn.Context())
 }
 
 type RedisGetRequest struct {
@@ -231,22 +551,61 @@ func (r *RedisGetRequest) ID(id int64) *RedisGetRequest {
 	return r
 }
 
-// Get listID of person. Returns 0 if not found
-func (r *RedisGetRequest) GetPersonList() WL {
-	if r.id == 0 {
-		n, err := r.conn.doInt("GET", r.key)
-		if err != nil {
-			log.Println("ERROR:", err)
-			return 0
-		}
-		return WL(n)
+// Get settings of the chat. false is returned if the chat has none.
+// Lifetime of the hash is extended, so settings of active people don't expire
+func (r *RedisGetRequest) GetSettings() (s Settings, ok bool, err error) {
+	key := fmt.Sprintf("settings:%d", r.id)
+	replies, err := r.conn.NewRedisTransaction().
+		Cmd("HGETALL", key).
+		Cmd("EXPIRE", key, int(settingsTTL.Seconds())).
+		Exec(r.conn.Context())
+	if err != nil {
+		return
+	}
+	values, err := redis.Values(replies[0], nil)
+	if err != nil || len(values) == 0 {
+		return
+	}
+
+	s = defaultSettings()
+	err = redis.ScanStruct(values, &s)
+	return s, err == nil, err
+}
+
+// Before the settings hash every setting was kept in its own key.
+// Getters of these keys are used by the migration
+
+// Wordlists were stored by their numbers before the registry appeared
+var legacyWL = []WL{"bip39_en", "wordle_en", "dice_long_en", "dice_short1_en", "dice_short2_en"}
+
+// Get listID of person. The ID isn't checked with the registry, so the choice
+// isn't lost if the list isn't loaded at the moment
+func (r *RedisGetRequest) GetPersonList() (WL, error) {
+	key := r.key
+	if r.id != 0 {
+		key = fmt.Sprintf("plist:%d", r.id)
+	}
+
+	s, err := r.conn.doString("GET", key)
+	if err != nil {
+		return "", err
+	}
+
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < len(legacyWL) {
+		return legacyWL[n], nil
 	}
+	return WL(s), nil
+}
 
-	n, err := r.conn.doInt("GET", fmt.Sprintf("plist:%d", r.id))
+// Get wordlist uploaded by the person
+func (r *RedisGetRequest) GetUserList() (ul UserWordlist, err error) {
+	data, err := redis.Bytes(r.conn.do("GET", fmt.Sprintf("ulist:%d", r.id)))
 	if err != nil {
-		return 0
+		return
 	}
-	return WL(n)
+
+	err = json.Unmarshal(data, &ul)
+	return
 }
 
 func (r *RedisGetRequest) GetLastAction() (LastAction, error) {
@@ -259,11 +618,183 @@ func (r *RedisGetRequest) GetWordsNumber() (int, error) {
 	return n, err
 }
 
+// Get target entropy of the person. Returns 0 if the fixed number of words is used
+func (r *RedisGetRequest) GetTargetEntropy() (int, error) {
+	n, err := r.conn.doInt("GET", fmt.Sprintf("wbits:%d", r.id))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Get transformations of the person. Returns 0 if there are none
+func (r *RedisGetRequest) GetTransforms() (Transform, error) {
+	n, err := r.conn.doInt("GET", fmt.Sprintf("trans:%d", r.id))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return Transform(n) & transAll, err
+}
+
+// Get ID of the policy of the person. Returns empty string if there is none
+func (r *RedisGetRequest) GetPolicyID() (string, error) {
+	id, err := r.conn.doString("GET", fmt.Sprintf("policy:%d", r.id))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return id, err
+}
+
+// Get policy defined by the person
+func (r *RedisGetRequest) GetUserPolicy(id string) (p Policy, err error) {
+	data, err := redis.Bytes(r.conn.do("HGET", fmt.Sprintf("policies:%d", r.id), id))
+	if err == redis.ErrNil {
+		return p, ErrPolicyNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &p)
+	return
+}
+
+// Get all policies defined by the person sorted by name
+func (r *RedisGetRequest) GetUserPolicies() ([]Policy, error) {
+	values, err := redis.ByteSlices(r.conn.do("HVALS", fmt.Sprintf("policies:%d", r.id)))
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]Policy, 0, len(values))
+	for _, v := range values {
+		var p Policy
+		if err := json.Unmarshal(v, &p); err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies, nil
+}
+
+// Get number of words of BIP39 mnemonics of the person. Returns 0 if the mode is off
+func (r *RedisGetRequest) GetMnemonicWords() (int, error) {
+	n, err := r.conn.doInt("GET", fmt.Sprintf("bip39:%d", r.id))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Get whether passphrases generated in the group are sent to the private chat
+func (r *RedisGetRequest) GetPrivateDelivery() (bool, error) {
+	private, err := redis.Bool(r.conn.do("GET", fmt.Sprintf("gdm:%d", r.id)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return private, err
+}
+
+// Get lifetime in minutes of messages with passphrases in the chat. Returns 0 if they aren't deleted
+func (r *RedisGetRequest) GetSelfDestruct() (int, error) {
+	ttl, err := r.conn.doInt("GET", fmt.Sprintf("ttl:%d", r.id))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return ttl, err
+}
+
+// Get messages that have to be deleted before the time
+func (r *RedisGetRequest) GetDueDeletions(now time.Time) ([]ScheduledDeletion, error) {
+	members, err := redis.Strings(r.conn.do("ZRANGEBYSCORE", "selfdestruct", "-inf", now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	due := make([]ScheduledDeletion, 0, len(members))
+	for _, m := range members {
+		d, err := parseScheduledDeletion(m)
+		if err != nil {
+			// It would be returned every time, so it's removed
+			logger.Warn("Invalid scheduled deletion", zap.Error(err), zap.String("member", m))
+			if _, err := r.conn.do("ZREM", "selfdestruct", m); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		due = append(due, d)
+	}
+	return due, nil
+}
+
 func (r *RedisGetRequest) GetSeparator() (string, error) {
 	s, err := r.conn.doString("GET", fmt.Sprintf("sep:%d", r.id))
 	return s, err
 }
 
+func (r *RedisGetRequest) GetLastActionArg() (string, error) {
+	s, err := r.conn.doString("GET", fmt.Sprintf("lastarg:%d", r.id))
+	return s, err
+}
+
+// Get salt of the vault key. Returns nil if the person has no salt yet
+func (r *RedisGetRequest) GetVaultSalt() ([]byte, error) {
+	salt, err := redis.Bytes(r.conn.do("GET", fmt.Sprintf("vsalt:%d", r.id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return salt, err
+}
+
+// Get verifier of the encryption password. Returns nil if the password isn't set
+func (r *RedisGetRequest) GetEncVerifier() ([]byte, error) {
+	verifier, err := redis.Bytes(r.conn.do("GET", fmt.Sprintf("encver:%d", r.id)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return verifier, err
+}
+
+// Check whether the vault of the person is unlocked
+func (r *RedisGetRequest) GetUnlocked() (bool, error) {
+	return redis.Bool(r.conn.do("EXISTS", fmt.Sprintf("unlocked:%d", r.id)))
+}
+
+// Get all entries of the vault sorted from the newest to the oldest
+func (r *RedisGetRequest) GetVaultEntries() ([]VaultEntry, error) {
+	values, err := redis.ByteSlices(r.conn.do("HVALS", fmt.Sprintf("vault:%d", r.id)))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]VaultEntry, 0, len(values))
+	for _, v := range values {
+		var e VaultEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	sortVaultEntries(entries)
+	return entries, nil
+}
+
+// Get one entry of the vault by its ID
+func (r *RedisGetRequest) GetVaultEntry(entryID int64) (e VaultEntry, err error) {
+	data, err := redis.Bytes(r.conn.do("HGET", fmt.Sprintf("vault:%d", r.id), entryID))
+	if err == redis.ErrNil {
+		return e, ErrVaultEntryNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &e)
+	return
+}
+
 type RedisDelRequest struct {
 	conn RedisConn
 	id   int64  // any id as a part of redis key (after colon)
@@ -303,7 +834,67 @@ func (r *RedisDelRequest) DeleteLastAction() error {
 	if r.id == 0 {
 		return errors.New("You have to specify id of a person")
 	}
-	r.Key(fmt.Sprintf("lastact:%d", r.id))
-	err := r.Exec()
+	_, err := r.conn.do("DEL", fmt.Sprintf("lastact:%d", r.id), fmt.Sprintf("lastarg:%d", r.id))
+	return err
+}
+
+// Delete policy defined by the person
+func (r *RedisDelRequest) DeleteUserPolicy(id string) error {
+	if r.id == 0 {
+		return errors.New("You have to specify id of a person")
+	}
+	n, err := r.conn.doInt("HDEL", fmt.Sprintf("policies:%d", r.id), id)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrPolicyNotFound
+	}
+	return nil
+}
+
+// You have to specify conn and id in order to use this function
+func (r *RedisDelRequest) DeleteVaultEntry(entryID int64) error {
+	if r.id == 0 {
+		return errors.New("You have to specify id of a person")
+	}
+	n, err := r.conn.doInt("HDEL", fmt.Sprintf("vault:%d", r.id), entryID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrVaultEntryNotFound
+	}
+	return nil
+}
+
+// DeleteVault deletes all entries of the vault together with
+// the salt and the verifier of the encryption password
+func (r *RedisDelRequest) DeleteVault() error {
+	if r.id == 0 {
+		return errors.New("You have to specify id of a person")
+	}
+	_, err := r.conn.do("DEL",
+		fmt.Sprintf("vault:%d", r.id),
+		fmt.Sprintf("vseq:%d", r.id),
+		fmt.Sprintf("vsalt:%d", r.id),
+		fmt.Sprintf("encver:%d", r.id),
+		fmt.Sprintf("unlocked:%d", r.id),
+	)
+	return err
+}
+
+// You have to specify conn and id in order to use this function
+func (r *RedisDelRequest) DeleteUnlocked() error {
+	if r.id == 0 {
+		return errors.New("You have to specify id of a person")
+	}
+	r.Key(fmt.Sprintf("unlocked:%d", r.id))
+	return r.Exec()
+}
+
+// Forget the scheduled deletion of the message
+func (r *RedisDelRequest) DeleteScheduledDeletion(d ScheduledDeletion) error {
+	_, err := r.conn.do("ZREM", "selfdestruct", d.String())
 	return err
 }
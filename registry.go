@@ -0,0 +1,182 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// Wordlists are shipped inside the binary, so the bot starts the same way without network access
+//
+//go:embed wordlists
+var embeddedWordlists embed.FS
+
+// manifestFile describes every wordlist in the wordlists directory
+const manifestFile = "manifest.json"
+
+var (
+	ErrWordlistNotFound = errors.New("Wordlist file is not found")
+	ErrInvalidManifest  = errors.New("Wordlist manifest is invalid")
+)
+
+// Wordlist IDs are used in callback data and as Redis values
+var wlIDPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// wordlistManifestEntry is one wordlist in the manifest
+type wordlistManifestEntry struct {
+	ID          WL     `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Language    string `json:"language"`
+	Source      string `json:"source"`
+	File        string `json:"file"`
+	URL         string `json:"url,omitempty"`  // Used to refresh the list
+	Size        int    `json:"size,omitempty"` // Expected number of words, any if it's 0
+	Dice        int    `json:"dice,omitempty"` // Number of dice for one word if the list is made for physical dice
+	Example     string `json:"example"`
+}
+
+var (
+	wlOrder []WL // Wordlists in the order of the manifest
+	defwl   WL   // The first wordlist of the manifest is the default one
+)
+
+// wordlistsDir returns the directory with the manifest and wordlists.
+// PASSPHRASEBOT_WORDLISTS_DIR lets operators add lists without recompiling,
+// otherwise the embedded directory is used
+func wordlistsDir() fs.FS {
+	if dir := os.Getenv("PASSPHRASEBOT_WORDLISTS_DIR"); dir != "" {
+		logger.Info("Using wordlists directory", zap.String("dir", dir))
+		return os.DirFS(dir)
+	}
+
+	sub, err := fs.Sub(embeddedWordlists, "wordlists")
+	errPanic(err)
+	return sub
+}
+
+// readManifest reads and checks the manifest of the wordlists directory
+func readManifest(fsys fs.FS) ([]wordlistManifestEntry, error) {
+	data, err := fs.ReadFile(fsys, manifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []wordlistManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidManifest, err)
+	}
+
+	seen := make(map[WL]bool, len(entries))
+	for i, e := range entries {
+		switch {
+		case !wlIDPattern.MatchString(string(e.ID)) || e.ID == userwl:
+			return nil, fmt.Errorf("%w: entry %d has invalid id %q", ErrInvalidManifest, i+1, e.ID)
+		case seen[e.ID]:
+			return nil, fmt.Errorf("%w: id %q is used twice", ErrInvalidManifest, e.ID)
+		case e.Name == "":
+			return nil, fmt.Errorf("%w: %q has no name", ErrInvalidManifest, e.ID)
+		case e.File == "":
+			return nil, fmt.Errorf("%w: %q has no file", ErrInvalidManifest, e.ID)
+		}
+		seen[e.ID] = true
+	}
+
+	return entries, nil
+}
+
+// loadWordlists fills the registry with wordlists from the manifest.
+// Every list has to be loaded, otherwise settings of people who chose
+// the missing list would silently change, so the bot doesn't start
+func loadWordlists() {
+	fsys := wordlistsDir()
+	entries, err := readManifest(fsys)
+	errPanic(err)
+
+	for _, e := range entries {
+		wl := &Wordlist{
+			id:          e.ID,
+			size:        e.Size,
+			file:        e.File,
+			uri:         e.URL,
+			name:        e.Name,
+			description: e.Description,
+			language:    e.Language,
+			source:      e.Source,
+			example:     e.Example,
+			dice:        e.Dice,
+		}
+
+		if err := wl.Fill(fsys); err != nil {
+			logger.Fatal("Can't load wordlist", zap.Error(err), zap.String("wordlist", e.Name))
+		}
+
+		if wl.dice > 0 && wl.Size() != dicePow(wl.dice) {
+			logger.Error("Wordlist size doesn't match number of dice", zap.String("wordlist", e.Name), zap.Int("dice", wl.dice))
+			wl.dice = 0
+		}
+
+		Wordlists[wl.id] = wl
+		wlOrder = append(wlOrder, wl.id)
+	}
+
+	if len(wlOrder) == 0 {
+		logger.Panic("No wordlists are loaded")
+	}
+	defwl = wlOrder[0]
+	logger.Info("Loaded wordlists", zap.Int("count", len(wlOrder)))
+}
+
+// refreshWordlists downloads all wordlists every period.
+// A list is replaced only if the downloaded version is valid
+func refreshWordlists(period time.Duration) {
+	for {
+		for _, id := range wlOrder {
+			wl := Wordlists[id]
+			if wl.URI() == "" {
+				continue
+			}
+			if err := wl.Refresh(); err != nil {
+				logger.Warn("Can't refresh wordlist", zap.Error(err), zap.String("wordlist", wl.Name()))
+			}
+		}
+		time.Sleep(period)
+	}
+}
+
+// startWordlistRefresh starts refreshing of wordlists if
+// PASSPHRASEBOT_WORDLIST_REFRESH is set to a duration like 24h
+func startWordlistRefresh() {
+	period, err := time.ParseDuration(os.Getenv("PASSPHRASEBOT_WORDLIST_REFRESH"))
+	if err != nil || period <= 0 {
+		return
+	}
+	logger.Info("Wordlists will be refreshed", zap.Duration("period", period))
+	go refreshWordlists(period)
+}
+
+// wordlistsDescription returns the text of /list message built from the registry
+func wordlistsDescription() string {
+	var sb strings.Builder
+	sb.WriteString("<b>Select desired wordlist</b>\n\nHere are some examples of generated passphrases:")
+	for _, id := range wlOrder {
+		wl := Wordlists[id]
+		sb.WriteString(fmt.Sprintf("\n\n<b>%s</b>", tgbotapi.EscapeText(tgbotapi.ModeHTML, wl.Name())))
+		if wl.Description() != "" {
+			sb.WriteString("\n" + tgbotapi.EscapeText(tgbotapi.ModeHTML, wl.Description()))
+		}
+		if wl.Example() != "" {
+			sb.WriteString(fmt.Sprintf("\n<code>%s</code>", tgbotapi.EscapeText(tgbotapi.ModeHTML, wl.Example())))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/fs"
+	"testing"
+)
+
+// TestEmbeddedWordlists fills every list of the embedded manifest,
+// so a list without its file can't be shipped
+func TestEmbeddedWordlists(t *testing.T) {
+	fsys, err := fs.Sub(embeddedWordlists, "wordlists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readManifest(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatal("manifest is empty")
+	}
+
+	for _, e := range entries {
+		wl := &Wordlist{id: e.ID, file: e.File, size: e.Size, dice: e.Dice}
+		if err := wl.Fill(fsys); err != nil {
+			t.Errorf("%s: %v", e.ID, err)
+			continue
+		}
+		if wl.Size() != e.Size {
+			t.Errorf("%s: got %d words, want %d", e.ID, wl.Size(), e.Size)
+		}
+		if e.Dice > 0 && wl.Size() != dicePow(e.Dice) {
+			t.Errorf("%s: %d words don't match %d dice", e.ID, wl.Size(), e.Dice)
+		}
+	}
+}
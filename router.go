@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+// HandlerFunc handles the update. Every handler is wrapped by middlewares
+type HandlerFunc func(ctx context.Context, upd tgbotapi.Update) error
+
+// Middleware wraps the handler, for example to log or recover from panics
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// CommandFunc handles the command and returns a message that has to be sent.
+// Message without text isn't sent, so the handler can send messages itself
+type CommandFunc func(ctx context.Context, m *tgbotapi.Message) tgbotapi.MessageConfig
+
+// MessageFunc handles the message and sends answers itself
+type MessageFunc func(ctx context.Context, m *tgbotapi.Message) error
+
+// CallbackFunc handles the click on the button. arg is the part of callback data after "$$"
+type CallbackFunc func(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error
+
+// LastActionFunc handles the text the person sent after the command that waits for it
+type LastActionFunc func(ctx context.Context, conn RedisConn, la LastAction, m *tgbotapi.Message) error
+
+// InlineFunc answers the inline query
+type InlineFunc func(ctx context.Context, iq *tgbotapi.InlineQuery) error
+
+type callbackRoute struct {
+	h       CallbackFunc
+	failure string // Answer to the person if the handler fails
+}
+
+// Router dispatches updates to handlers registered for commands, text triggers,
+// callback prefixes and last actions. Commands with descriptions are
+// published to the menu of Telegram in the order of registration
+type Router struct {
+	commands      map[string]CommandFunc
+	groupCommands map[string]CommandFunc
+	menu          []tgbotapi.BotCommand
+	groupMenu     []tgbotapi.BotCommand
+
+	texts       map[string]MessageFunc
+	callbacks   map[string]callbackRoute
+	lastActions map[LastAction]LastActionFunc
+	document    MessageFunc
+	inline      InlineFunc
+
+	middlewares []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{
+		commands:      make(map[string]CommandFunc),
+		groupCommands: make(map[string]CommandFunc),
+		texts:         make(map[string]MessageFunc),
+		callbacks:     make(map[string]callbackRoute),
+		lastActions:   make(map[LastAction]LastActionFunc),
+	}
+}
+
+// Use adds middlewares. The first one is the outermost
+func (r *Router) Use(mw ...Middleware) {
+	r.middlewares = append(r.middlewares, mw...)
+}
+
+// Command registers the command of private chats. Commands without
+// description work, but aren't shown in the menu
+func (r *Router) Command(name, description string, h CommandFunc) {
+	r.commands[name] = h
+	if description != "" {
+		r.menu = append(r.menu, tgbotapi.BotCommand{Command: name, Description: description})
+	}
+}
+
+// GroupCommand registers the command of groups
+func (r *Router) GroupCommand(name, description string, h CommandFunc) {
+	r.groupCommands[name] = h
+	if description != "" {
+		r.groupMenu = append(r.groupMenu, tgbotapi.BotCommand{Command: name, Description: description})
+	}
+}
+
+// Text registers the handler of messages with exactly one of the texts,
+// for example the buttons of the reply keyboard
+func (r *Router) Text(h MessageFunc, texts ...string) {
+	for _, t := range texts {
+		r.texts[t] = h
+	}
+}
+
+// Callback registers the handler of buttons with callback data "prefix$$arg" or just "prefix"
+func (r *Router) Callback(prefix string, h CallbackFunc, failure string) {
+	r.callbacks[prefix] = callbackRoute{h: h, failure: failure}
+}
+
+// LastAction registers the handler of text sent when one of the last actions is set
+func (r *Router) LastAction(h LastActionFunc, las ...LastAction) {
+	for _, la := range las {
+		r.lastActions[la] = h
+	}
+}
+
+// Document registers the handler of documents of private chats
+func (r *Router) Document(h MessageFunc) {
+	r.document = h
+}
+
+// Inline registers the handler of inline queries
+func (r *Router) Inline(h InlineFunc) {
+	r.inline = h
+}
+
+// Handle dispatches the update to its handler wrapped by middlewares
+func (r *Router) Handle(ctx context.Context, upd tgbotapi.Update) {
+	name, h := r.route(upd)
+	if h == nil {
+		return
+	}
+
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		h = r.middlewares[i](h)
+	}
+	// Errors are logged by the middleware
+	h(context.WithValue(ctx, "route", name), upd)
+}
+
+// route returns name and handler of the update, nil if the update is ignored
+func (r *Router) route(upd tgbotapi.Update) (string, HandlerFunc) {
+	if cq := upd.CallbackQuery; cq != nil {
+		prefix, arg, _ := strings.Cut(cq.Data, "$$")
+		c, ok := r.callbacks[prefix]
+		if !ok {
+			logger.Warn("Got unknown callback data", zap.String("data", cq.Data))
+			return "", nil
+		}
+		return "callback " + prefix, func(ctx context.Context, upd tgbotapi.Update) error {
+			err := c.h(ctx, upd.CallbackQuery, arg)
+			// The middleware answers when Redis fails
+			if err != nil && c.failure != "" && !isRedisFailure(err) {
+				callbackAnswer(upd.CallbackQuery.ID, c.failure)
+			}
+			return err
+		}
+	}
+
+	if upd.InlineQuery != nil {
+		if r.inline == nil {
+			return "", nil
+		}
+		return "inline", func(ctx context.Context, upd tgbotapi.Update) error {
+			return r.inline(ctx, upd.InlineQuery)
+		}
+	}
+
+	m := upd.Message
+	if m == nil {
+		return "", nil
+	}
+
+	if isGroup(m.Chat) {
+		if !m.IsCommand() || !addressedToBot(m) || m.From == nil {
+			return "", nil
+		}
+		h, ok := r.groupCommands[m.Command()]
+		if !ok {
+			h = handlePersonalCommand
+		}
+		return "group /" + m.Command(), func(ctx context.Context, upd tgbotapi.Update) error {
+			msg := h(ctx, upd.Message)
+			if err := redisFailure(ctx); err != nil {
+				return err
+			}
+			// Answers in groups are replies, so it's clear whom they are for
+			if msg.ChatID == upd.Message.Chat.ID {
+				msg.ReplyToMessageID = upd.Message.MessageID
+			}
+			botSend(msg)
+			return nil
+		}
+	}
+
+	if m.Chat == nil || !m.Chat.IsPrivate() {
+		log.Printf("The message is not private:\n%s", ToJson(m.Chat))
+		return "", nil
+	}
+
+	if m.Document != nil && r.document != nil {
+		return "document", func(ctx context.Context, upd tgbotapi.Update) error {
+			return r.document(ctx, upd.Message)
+		}
+	}
+
+	if m.Text == "" {
+		log.Printf("Got non-text message from chat")
+		return "", nil
+	}
+
+	if h, ok := r.texts[m.Text]; ok {
+		return "text " + m.Text, func(ctx context.Context, upd tgbotapi.Update) error {
+			return h(ctx, upd.Message)
+		}
+	}
+
+	if m.IsCommand() {
+		h, ok := r.commands[m.Command()]
+		if !ok {
+			h = handleUnknownCommand
+		}
+		return "/" + m.Command(), func(ctx context.Context, upd tgbotapi.Update) error {
+			msg := h(ctx, upd.Message)
+			if err := redisFailure(ctx); err != nil {
+				return err
+			}
+			botSend(msg)
+			return nil
+		}
+	}
+
+	return "last action", r.handleLastAction
+}
+
+// handleLastAction passes the text to the handler of the last action of the person
+func (r *Router) handleLastAction(ctx context.Context, upd tgbotapi.Update) error {
+	conn, ok := ctx.Value("redis-conn").(RedisConn)
+	if !ok {
+		return ErrCantParseCtx
+	}
+
+	la, err := getLastAction(ctx)
+	if err != nil {
+		logger.Error("Can't get last action", zap.Error(err))
+		return err
+	}
+
+	h, ok := r.lastActions[la]
+	if !ok {
+		return removeLastAction(ctx)
+	}
+	return h(ctx, conn, la, upd.Message)
+}
+
+// redisFailure returns ErrRedisTimeout or ErrNoRedis if Redis has failed while the update was handled.
+// Command handlers turn errors into messages, so the answer is replaced after them
+func redisFailure(ctx context.Context) error {
+	conn, ok := ctx.Value("redis-conn").(RedisConn)
+	if !ok {
+		return nil
+	}
+	return conn.Failure()
+}
+
+// isRedisFailure reports whether the person is told about the error by redisFailureMiddleware
+func isRedisFailure(err error) bool {
+	return errors.Is(err, ErrRedisTimeout) || errors.Is(err, ErrNoRedis)
+}
+
+// PublishCommands sets the menu of commands in private chats and in groups
+func (r *Router) PublishCommands() error {
+	if _, err := bot.Request(tgbotapi.NewSetMyCommandsWithScope(tgbotapi.NewBotCommandScopeAllPrivateChats(), r.menu...)); err != nil {
+		return err
+	}
+	_, err := bot.Request(tgbotapi.NewSetMyCommandsWithScope(tgbotapi.NewBotCommandScopeAllGroupChats(), r.groupMenu...))
+	return err
+}
+
+// withConn passes the redis connection from the context to the command handler
+func withConn(h func(conn RedisConn, m *tgbotapi.Message) tgbotapi.MessageConfig) CommandFunc {
+	return func(ctx context.Context, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		conn, ok := ctx.Value("redis-conn").(RedisConn)
+		if !ok {
+			logger.Error("Can't get redis conn from context", zap.Error(ErrCantParseCtx))
+			return tgbotapi.NewMessage(m.Chat.ID, "Error on the server side. Sorry.")
+		}
+		return h(conn, m)
+	}
+}
+
+// withStorage passes the storage from the context to the command handler
+func withStorage(h func(ctx context.Context, st Storage, m *tgbotapi.Message) tgbotapi.MessageConfig) CommandFunc {
+	return func(ctx context.Context, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		st, ok := ctx.Value("storage").(Storage)
+		if !ok {
+			logger.Error("Can't get storage from context", zap.Error(ErrCantParseCtx))
+			return tgbotapi.NewMessage(m.Chat.ID, "Error on the server side. Sorry.")
+		}
+		return h(ctx, st, m)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// newRouter registers handlers of the bot. Order of commands is the order in the menu
+func newRouter() *Router {
+	r := NewRouter()
+	r.Use(recoverMiddleware, logMiddleware, redisFailureMiddleware, userMiddleware, rateLimitMiddleware(newRateLimiter(rateLimit, rateWindow)))
+
+	// Private chats
+	r.Command("start", "", handleStartCommand)
+	r.Command("help", "How to use the bot", handleHelpCommand)
+	r.Command("settings", "All settings with buttons", withStorage(func(ctx context.Context, st Storage, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return handleSettingsCommand(ctx, st, m.Chat.ID)
+	}))
+	r.Command("gen", "Choose one of several passphrases", withStorage(sendGenCommand))
+	r.Command("number", "Set number of words", handleNumberCommand)
+	r.Command("strength", "Set strength of passphrases in bits", handleStrengthCommand)
+	r.Command("sep", "Set separator between words", handleSepCommand)
+	r.Command("list", "Choose the wordlist", withStorage(handleListCommand))
+	r.Command("addlist", "Upload your own wordlist", func(ctx context.Context, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return handleAddListCommand(ctx, m.Chat.ID)
+	})
+	r.Command("transform", "Capital letters, digits and symbols", withStorage(handleTransformCommand))
+	r.Command("policy", "Choose password rules of a site", withStorage(handlePolicyCommand))
+	r.Command("addpolicy", "Define your own password rules", withStorage(func(ctx context.Context, st Storage, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return handleAddPolicyCommand(ctx, st, m.Chat.ID, m.CommandArguments())
+	}))
+	r.Command("delpolicy", "Delete your password rules", withStorage(func(ctx context.Context, st Storage, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return handleDelPolicyCommand(ctx, st, m.Chat.ID, m.CommandArguments())
+	}))
+	r.Command("bip39", "BIP39 mnemonics for crypto wallets", withStorage(handleBIP39Command))
+	r.Command("validate", "Check a BIP39 mnemonic", handleValidateCommand)
+	r.Command("dice", "Passphrase from physical dice", func(ctx context.Context, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return handleDiceCommand(m.Chat.ID)
+	})
+	r.Command("export", "File with many passphrases", handleExportCommand)
+	r.Command("autodelete", "Delete passphrases after a while", withStorage(func(ctx context.Context, st Storage, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return handleSelfDestructCommand(ctx, st, m.Chat.ID)
+	}))
+	r.Command("vault", "Saved passphrases", withConn(handleVaultCommand))
+	r.Command("search", "Find saved passphrases by note", func(ctx context.Context, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return startSearch(ctx, m.Chat.ID, m.CommandArguments())
+	})
+	r.Command("encryption", "Password that encrypts the vault", withConn(handleEncryptionCommand))
+	r.Command("unlock", "Use the vault without the password for a while", func(ctx context.Context, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return handleUnlockCommand(ctx, m.Chat.ID)
+	})
+	r.Command("lock", "Lock the vault", func(ctx context.Context, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return handleLockCommand(ctx, m.Chat.ID)
+	})
+
+	// Groups
+	r.GroupCommand("start", "", handleGroupHelpCommand)
+	r.GroupCommand("help", "How to use the bot in groups", handleGroupHelpCommand)
+	r.GroupCommand("gen", "Generate passphrases", withStorage(groupGenerate))
+	r.GroupCommand("settings", "Settings of the group", groupAdmin(withStorage(func(ctx context.Context, st Storage, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return handleSettingsCommand(ctx, st, m.Chat.ID)
+	})))
+	r.GroupCommand("number", "Set number of words of the group", groupAdmin(withStorage(handleGroupNumberCommand)))
+	r.GroupCommand("sep", "Set separator of the group", groupAdmin(withStorage(handleGroupSepCommand)))
+	r.GroupCommand("list", "Choose wordlist of the group", groupAdmin(handleGroupListCommand))
+	r.GroupCommand("delivery", "Send passphrases to private chats", groupAdmin(withStorage(handleGroupDeliveryCommand)))
+	r.GroupCommand("autodelete", "Delete passphrases after a while", groupAdmin(withStorage(func(ctx context.Context, st Storage, m *tgbotapi.Message) tgbotapi.MessageConfig {
+		return handleSelfDestructCommand(ctx, st, m.Chat.ID)
+	})))
+
+	// Buttons of the reply keyboard
+	r.Text(handleGenerateText, "Generate", "gen", "generate")
+	r.Text(handleBatchText, batchButton)
+
+	r.Document(handleDocument)
+	r.Inline(handleInlineQuery)
+
+	// Buttons of inline keyboards
+	r.Callback("system", handleSystemCallback, "")
+	r.Callback("setwl", handleWordlistCallback, "")
+	for _, action := range []string{"vpage", "vreveal", "vdel"} {
+		action := action
+		r.Callback(action, func(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+			return handleVaultCallback(ctx, cq, action, arg)
+		}, "")
+	}
+	r.Callback("policy", handlePolicyCallback, "Can't change the policy. Sorry.")
+	r.Callback("bip39", handleMnemonicCallback, "Can't change the mode. Sorry.")
+	r.Callback("keep", func(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+		return keepCandidate(cq, arg)
+	}, "Can't keep this passphrase. Sorry.")
+	r.Callback("dice", handleDiceCallback, "Can't use this wordlist. Sorry.")
+	r.Callback("set", handleSettingsCallback, "Can't change the setting. Sorry.")
+	r.Callback("ttl", handleSelfDestructCallback, "Can't change the setting. Sorry.")
+	r.Callback("trans", handleTransformCallback, "Can't change the option. Sorry.")
+	r.Callback("enc", handleEncryptionCallback, "")
+	r.Callback("regenerate", func(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+		return regeneratePassword(ctx, cq)
+	}, "")
+	r.Callback("delete", func(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+		return deleteMessage(cq.Message.Chat.ID, cq.Message.MessageID)
+	}, "")
+	r.Callback("save", func(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+		return savePassword(ctx, cq)
+	}, "Can't save this passphrase. Sorry.")
+	r.Callback("save_with_name", func(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+		return savePasswordNote(ctx, cq)
+	}, "Can't save this passphrase. Sorry.")
+
+	// Text that the bot waits for after commands
+	r.LastAction(handleNumberText, laSetNubmer)
+	r.LastAction(handleStrengthText, laSetStrength)
+	r.LastAction(handleSeparatorText, laSetSeparator)
+	// Messages with passwords, notes, rolls and mnemonics mustn't stay in the chat
+	r.LastAction(secretText(handleEncPassAction), laSetEncPass, laChangeEncPass, laNewEncPass, laDisableEncryption)
+	r.LastAction(secretText(handleVaultNoteAction), laVaultNote)
+	r.LastAction(secretText(handleVaultPasswordAction), laVaultSave, laVaultReveal, laVaultSearch, laVaultUnlock)
+	r.LastAction(secretText(handleDiceRollsAction), laDiceRolls)
+	r.LastAction(secretText(handleValidateAction), laValidateMnemonic)
+
+	return r
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	searchQueryMax   = 100 // Maximal length of the search query in bytes
+	searchResultsMax = 10  // Maximal number of entries in the search results
+	searchTTL        = 5 * time.Minute
+)
+
+var ErrNoPendingSearch = errors.New("There is no search waiting for the password")
+
+// pendingSearches keeps queries that wait for the encryption password.
+// Notes are encrypted, so the search works only on the decrypted vault
+// and the query itself doesn't get into the database either
+var pendingSearches = newPendingStore[string](searchTTL)
+
+// startSearch remembers the query and asks the user for the encryption password
+func startSearch(ctx context.Context, personID int64, query string) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		msg.Text = "Type the part of the note after the command, for example:\n<code>/search github</code>"
+		msg.ParseMode = tgbotapi.ModeHTML
+		return
+	}
+	if len(query) > searchQueryMax {
+		msg.Text = fmt.Sprintf("Search query has to be less than %d bytes long", searchQueryMax)
+		return
+	}
+
+	conn, ok := ctx.Value("redis-conn").(RedisConn)
+	if !ok {
+		logger.Error("Can't get redis conn from context", zap.Error(ErrCantParseCtx))
+		msg.Text = "Error on the server side. Sorry."
+		return
+	}
+	if enabled, err := encryptionEnabled(conn, personID); err != nil || !enabled {
+		msg.Text = "Your vault is empty. Set the encryption password with /encryption to save passphrases."
+		return
+	}
+
+	if key, ok := sessionKey(conn, personID); ok {
+		msg, err := vaultSearch(conn, personID, key, query)
+		if err != nil {
+			logger.Error("Can't search through the vault", zap.Error(err), zap.Int64("personid", personID))
+		}
+		return msg
+	}
+
+	if err := setLastAction(ctx, laVaultSearch); err != nil {
+		logger.Error("Can't set last action", zap.Error(err))
+		msg.Text = "Error on the server side. Sorry."
+		return
+	}
+	pendingSearches.Put(personID, query)
+
+	msg.Text = "Send me your encryption password to search through the notes. The message with the password will be deleted immediately."
+	msg.ReplyMarkup = IKBCancelAction
+	return
+}
+
+// vaultSearch decrypts the vault of the person and
+// returns entries which notes contain the query
+func vaultSearch(conn RedisConn, personID int64, key []byte, query string) (msg tgbotapi.MessageConfig, err error) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	entries, err := conn.NewRedisGetRequest().ID(personID).GetVaultEntries()
+	if err != nil {
+		msg.Text = "Can't open your vault. Sorry."
+		return msg, err
+	}
+
+	var found []string
+	total := 0
+	for _, e := range entries {
+		item, err := e.Open(key, personID)
+		if err != nil {
+			logger.Error("Can't decrypt vault entry", zap.Error(err), zap.Int64("personid", personID), zap.Int64("entry", e.ID))
+			continue
+		}
+		if !noteMatches(item.Note, query) {
+			continue
+		}
+		total++
+		if len(found) < searchResultsMax {
+			found = append(found, formatVaultItem(e, item))
+		}
+	}
+
+	if total == 0 {
+		msg.Text = fmt.Sprintf("Nothing found for <b>%s</b>", tgbotapi.EscapeText(tgbotapi.ModeHTML, query))
+		msg.ParseMode = tgbotapi.ModeHTML
+		return msg, nil
+	}
+
+	msg.Text = fmt.Sprintf("Found %d for <b>%s</b>", total, tgbotapi.EscapeText(tgbotapi.ModeHTML, query))
+	if total > len(found) {
+		msg.Text += fmt.Sprintf(", showing the newest %d", len(found))
+	}
+	msg.Text += "\n\n" + strings.Join(found, "\n\n")
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = inlDeleteOnly()
+	return msg, nil
+}
+
+// noteMatches reports whether the note contains the query ignoring case
+func noteMatches(note, query string) bool {
+	return strings.Contains(strings.ToLower(note), strings.ToLower(query))
+}
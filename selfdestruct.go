@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
+)
+
+// selfDestructInterval is how often the scheduler looks for due messages
+const selfDestructInterval = 10 * time.Second
+
+// selfDestructTTLs are the offered lifetimes of messages in minutes, 0 is off
+var selfDestructTTLs = []int{0, 1, 5, 60}
+
+var ErrInvalidTTL = errors.New("Messages can be deleted after 1, 5 or 60 minutes")
+
+// validTTL reports whether the lifetime of messages can be chosen
+func validTTL(ttl int) bool {
+	for _, t := range selfDestructTTLs {
+		if t == ttl {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduledDeletion is the message that has to be deleted.
+// In Redis it is stored as "chatID:messageID"
+type ScheduledDeletion struct {
+	ChatID    int64
+	MessageID int
+}
+
+func (d ScheduledDeletion) String() string {
+	return fmt.Sprintf("%d:%d", d.ChatID, d.MessageID)
+}
+
+// parseScheduledDeletion parses the member of the sorted set
+func parseScheduledDeletion(s string) (d ScheduledDeletion, err error) {
+	chat, msg, _ := strings.Cut(s, ":")
+	if d.ChatID, err = strconv.ParseInt(chat, 10, 64); err != nil {
+		return
+	}
+	d.MessageID, err = strconv.Atoi(msg)
+	return
+}
+
+// sendSelfDestructing sends the message with passphrases and schedules
+// its deletion if the chat has chosen the lifetime of such messages
+func sendSelfDestructing(ctx context.Context, st Storage, chatID int64, c tgbotapi.Chattable) error {
+	sent, err := bot.Send(c)
+	if err != nil {
+		logger.Error("Can't send message to user", zap.Error(err), zap.Int64("chatid", chatID))
+		return err
+	}
+
+	s, err := st.Settings(ctx, chatID)
+	if err != nil {
+		logger.Warn("Can't get lifetime of messages", zap.Error(err), zap.Int64("chatid", chatID))
+		return nil
+	}
+	if s.SelfDestruct == 0 {
+		return nil
+	}
+
+	d := ScheduledDeletion{ChatID: sent.Chat.ID, MessageID: sent.MessageID}
+	err = st.ScheduleDeletion(ctx, d, time.Now().Add(time.Duration(s.SelfDestruct)*time.Minute))
+	if err != nil {
+		logger.Error("Can't schedule deletion of message", zap.Error(err), zap.Int64("chatid", chatID))
+	}
+	return err
+}
+
+// startSelfDestruct runs the scheduler that deletes due messages.
+// Every run has its own connection, so a broken one isn't reused
+func startSelfDestruct(pool *redis.Pool, newStorage StorageFunc) {
+	go func() {
+		ticker := time.NewTicker(selfDestructInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			// A run doesn't take longer than the time till the next one
+			ctx, cancel := context.WithTimeout(context.Background(), selfDestructInterval)
+			conn := NewConn(pool)
+			deleteDueMessages(ctx, newStorage(conn))
+			conn.Close()
+			cancel()
+		}
+	}()
+}
+
+// deleteDueMessages deletes messages whose time has come. Messages that
+// can't be deleted (for example, already deleted by the user) are forgotten
+func deleteDueMessages(ctx context.Context, st Storage) {
+	due, err := st.DueDeletions(ctx, time.Now())
+	if err != nil {
+		logger.Error("Can't get scheduled deletions", zap.Error(err))
+		return
+	}
+
+	for _, d := range due {
+		if err := deleteMessage(d.ChatID, d.MessageID); err != nil {
+			logger.Warn("Can't delete scheduled message", zap.Error(err), zap.Int64("chatid", d.ChatID))
+		}
+		if err := st.DeleteScheduledDeletion(ctx, d); err != nil {
+			logger.Error("Can't remove scheduled deletion", zap.Error(err), zap.Int64("chatid", d.ChatID))
+		}
+	}
+}
+
+// selfDestructText returns text of /autodelete command
+func selfDestructText(ttl int) string {
+	text := "<b>Self-destructing messages</b>\n\nMessages with generated passphrases can be deleted automatically, so they don't stay in the chat history.\n\n"
+	if ttl == 0 {
+		return text + "Messages are not deleted."
+	}
+	return text + fmt.Sprintf("Messages are deleted after %s.", ttlText(ttl))
+}
+
+// ttlText returns the lifetime in minutes for people
+func ttlText(ttl int) string {
+	if ttl == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", ttl)
+}
+
+// handleSelfDestructCommand shows the current lifetime of messages of the chat
+func handleSelfDestructCommand(ctx context.Context, st Storage, chatID int64) (msg tgbotapi.MessageConfig) {
+	s, err := st.Settings(ctx, chatID)
+	if err != nil {
+		logger.Warn("Can't get lifetime of messages", zap.Error(err), zap.Int64("chatid", chatID))
+	}
+	msg = tgbotapi.NewMessage(chatID, selfDestructText(s.SelfDestruct))
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = IKBSelfDestruct(s.SelfDestruct)
+	return
+}
+
+// handleSelfDestructCallback sets lifetime of messages of the chat, 0 turns deletion off.
+// Messages that are already sent keep their time of deletion
+func handleSelfDestructCallback(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		return ErrCantParseCtx
+	}
+	if !canChangeChatSettings(cq) {
+		callbackAnswer(cq.ID, ErrNotChatAdmin.Error())
+		return nil
+	}
+
+	ttl := ParseInt(arg)
+	if !validTTL(ttl) {
+		return ErrInvalidTTL
+	}
+	chatID := cq.Message.Chat.ID
+	if err := updateSettings(ctx, st, chatID, func(s *Settings) { s.SelfDestruct = ttl }); err != nil {
+		return err
+	}
+
+	ec := tgbotapi.NewEditMessageTextAndMarkup(chatID, cq.Message.MessageID, selfDestructText(ttl), IKBSelfDestruct(ttl))
+	ec.ParseMode = tgbotapi.ModeHTML
+	if _, err := bot.Request(ec); err != nil {
+		return err
+	}
+
+	if ttl == 0 {
+		callbackAnswer(cq.ID, "Messages won't be deleted")
+	} else {
+		callbackAnswer(cq.ID, fmt.Sprintf("New messages will be deleted after %s", ttlText(ttl)))
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+const defUnlockMinutes = 15 // Default duration of the unlock session
+
+// unlockSession holds the vault key of the person while the vault is unlocked
+type unlockSession struct {
+	key   []byte
+	timer *time.Timer
+}
+
+// sessions keeps derived vault keys only in the memory of the process.
+// Redis knows only whether the session is active (see SetUnlocked),
+// the key material itself is never written there
+var sessions = struct {
+	sync.Mutex
+	m map[int64]*unlockSession
+}{m: make(map[int64]*unlockSession)}
+
+// unlockDuration returns the duration of the unlock session.
+// It can be changed with PASSPHRASEBOT_UNLOCK_MINUTES environment variable
+func unlockDuration() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("PASSPHRASEBOT_UNLOCK_MINUTES")); err == nil && n > 0 {
+		return time.Duration(n) * time.Minute
+	}
+	return defUnlockMinutes * time.Minute
+}
+
+// wipe overwrites the key, so it doesn't stay in the memory
+func wipe(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
+}
+
+// startSession keeps the key of the person in memory for d
+// and wipes it afterwards. Previous session is replaced
+func startSession(personID int64, key []byte, d time.Duration) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if s, ok := sessions.m[personID]; ok {
+		s.timer.Stop()
+		wipe(s.key)
+	}
+
+	s := &unlockSession{key: key}
+	s.timer = time.AfterFunc(d, func() {
+		sessions.Lock()
+		defer sessions.Unlock()
+		if sessions.m[personID] == s {
+			delete(sessions.m, personID)
+		}
+		wipe(s.key)
+		logger.Info("Vault session expired", zap.Int64("personid", personID))
+	})
+	sessions.m[personID] = s
+}
+
+// endSession wipes the key of the person if the vault is unlocked
+func endSession(personID int64) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if s, ok := sessions.m[personID]; ok {
+		s.timer.Stop()
+		wipe(s.key)
+		delete(sessions.m, personID)
+	}
+}
+
+// sessionKey returns the key of the person if the vault is unlocked.
+// The session is active only while both the key is in memory and
+// the flag is in Redis, so the vault locked in any way stays locked
+func sessionKey(conn RedisConn, personID int64) ([]byte, bool) {
+	sessions.Lock()
+	s, ok := sessions.m[personID]
+	var key []byte
+	if ok {
+		key = append(key, s.key...)
+	}
+	sessions.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	unlocked, err := conn.NewRedisGetRequest().ID(personID).GetUnlocked()
+	if err != nil {
+		logger.Error("Can't check unlock session", zap.Error(err), zap.Int64("personid", personID))
+		return nil, false
+	}
+	if !unlocked {
+		endSession(personID)
+		return nil, false
+	}
+
+	return key, true
+}
+
+// vaultUnlock starts the unlock session with the key
+func vaultUnlock(conn RedisConn, personID int64, key []byte) (msg tgbotapi.MessageConfig, err error) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	d := unlockDuration()
+	if err = conn.NewRedisSetRequest().SetUnlocked(personID, d); err != nil {
+		msg.Text = "Can't unlock the vault. Sorry."
+		return msg, err
+	}
+	startSession(personID, key, d)
+
+	msg.Text = fmt.Sprintf("🔓 Vault is unlocked for %d minutes. You won't be asked for the encryption password until then. Type /lock to lock it now.", int(d.Minutes()))
+	logger.Info("Unlocked vault of user", zap.Int64("personid", personID))
+	return msg, nil
+}
+
+// lockVault ends the unlock session of the person
+func lockVault(conn RedisConn, personID int64) error {
+	endSession(personID)
+	return conn.NewRedisDelRequest().ID(personID).DeleteUnlocked()
+}
+
+// handleUnlockCommand asks for the encryption password to unlock the vault
+func handleUnlockCommand(ctx context.Context, personID int64) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	conn, ok := ctx.Value("redis-conn").(RedisConn)
+	if !ok {
+		logger.Error("Can't get redis conn from context", zap.Error(ErrCantParseCtx))
+		msg.Text = "Error on the server side. Sorry."
+		return
+	}
+	if enabled, err := encryptionEnabled(conn, personID); err != nil || !enabled {
+		msg.Text = "Set the encryption password with /encryption first."
+		return
+	}
+	if _, ok := sessionKey(conn, personID); ok {
+		msg.Text = "Vault is already unlocked. Type /lock to lock it."
+		return
+	}
+
+	if err := setLastAction(ctx, laVaultUnlock); err != nil {
+		logger.Error("Can't set last action", zap.Error(err))
+		msg.Text = "Error on the server side. Sorry."
+		return
+	}
+
+	msg.Text = "Send me your encryption password to unlock the vault. The message with the password will be deleted immediately."
+	msg.ReplyMarkup = IKBCancelAction
+	return
+}
+
+// handleLockCommand locks the vault immediately
+func handleLockCommand(ctx context.Context, personID int64) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	conn, ok := ctx.Value("redis-conn").(RedisConn)
+	if !ok {
+		logger.Error("Can't get redis conn from context", zap.Error(ErrCantParseCtx))
+		msg.Text = "Error on the server side. Sorry."
+		return
+	}
+
+	if err := lockVault(conn, personID); err != nil {
+		logger.Error("Can't lock the vault", zap.Error(err), zap.Int64("personid", personID))
+		msg.Text = "Can't lock the vault. Sorry."
+		return
+	}
+
+	msg.Text = "🔒 Vault is locked."
+	return
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+var ErrUnknownSetting = errors.New("Unknown setting")
+
+// separatorPreset is the separator offered on the keyboard of /settings
+type separatorPreset struct {
+	sep  string
+	name string
+}
+
+var separatorPresets = []separatorPreset{
+	{"-", "-"},
+	{"_", "_"},
+	{".", "."},
+	{" ", "space"},
+	{"", "none"},
+}
+
+// separatorText returns the separator for people, invisible ones are named
+func separatorText(sep string) string {
+	switch sep {
+	case "":
+		return "none"
+	case " ":
+		return "space"
+	case "\n":
+		return "newline"
+	}
+	return fmt.Sprintf("<code>%s</code>", tgbotapi.EscapeText(tgbotapi.ModeHTML, sep))
+}
+
+// settingsText returns text of /settings message with the current settings of the chat
+func settingsText(ctx context.Context, st Storage, chatID int64) string {
+	gpc := personGenerateConfig(ctx, st, chatID)
+
+	var sb strings.Builder
+	sb.WriteString("<b>Settings</b>\n")
+	sb.WriteString(fmt.Sprintf("\nWordlist: <b>%s</b>", tgbotapi.EscapeText(tgbotapi.ModeHTML, gpc.list().Name())))
+	switch {
+	case gpc.mnemonic != 0:
+		sb.WriteString(fmt.Sprintf("\nBIP39 mnemonics: <b>%d words</b>", gpc.mnemonic))
+	case gpc.target > 0:
+		sb.WriteString(fmt.Sprintf("\nStrength: <b>at least %.0f bits</b> (%d words)", gpc.target, gpc.WordCount()))
+	default:
+		sb.WriteString(fmt.Sprintf("\nWords: <b>%d</b>", gpc.WordCount()))
+	}
+	sb.WriteString("\nSeparator: " + separatorText(gpc.separator))
+
+	var trans []string
+	for _, o := range transformOptions {
+		if gpc.transform.Has(o.t) {
+			trans = append(trans, o.name)
+		}
+	}
+	if len(trans) == 0 {
+		trans = append(trans, "none")
+	}
+	sb.WriteString("\nTransformations: " + strings.Join(trans, ", "))
+
+	policy := "none"
+	if gpc.policy != nil {
+		policy = tgbotapi.EscapeText(tgbotapi.ModeHTML, gpc.policy.Name)
+	}
+	sb.WriteString("\nPolicy: " + policy)
+
+	s, err := st.Settings(ctx, chatID)
+	if err != nil {
+		logger.Warn("Can't get lifetime of messages", zap.Error(err), zap.Int64("chatid", chatID))
+	}
+	if s.SelfDestruct == 0 {
+		sb.WriteString("\nAuto-delete: off")
+	} else {
+		sb.WriteString("\nAuto-delete: after " + ttlText(s.SelfDestruct))
+	}
+
+	sb.WriteString(fmt.Sprintf("\n\nEntropy: <b>%.1f bits</b>", gpc.Entropy()))
+	sb.WriteString("\n\nOther options: /strength /transform /policy /bip39 /autodelete")
+	return sb.String()
+}
+
+// handleSettingsCommand sends the message with settings of the chat and buttons to change them
+func handleSettingsCommand(ctx context.Context, st Storage, chatID int64) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(chatID, settingsText(ctx, st, chatID))
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = IKBSettings(currentSeparator(ctx, st, chatID))
+	return
+}
+
+// currentSeparator returns the separator of the chat or the default one
+func currentSeparator(ctx context.Context, st Storage, chatID int64) string {
+	s, err := st.Settings(ctx, chatID)
+	if err != nil {
+		return defsep
+	}
+	return s.Separator
+}
+
+// stepWords returns number of words after a click on +/- button.
+// In BIP39 mode only allowed lengths of mnemonics are used
+func stepWords(gpc *GeneratePasswordConfig, step int) (n int, ok bool) {
+	if gpc.mnemonic != 0 {
+		for i, l := range mnemonicLengths {
+			if l == gpc.mnemonic && i+step >= 0 && i+step < len(mnemonicLengths) {
+				return mnemonicLengths[i+step], true
+			}
+		}
+		return gpc.mnemonic, false
+	}
+
+	n = gpc.WordCount() + step
+	return n, n >= 1 && n <= maxlen
+}
+
+// handleSettingsCallback changes the setting and edits the message of /settings in place.
+// Settings belong to the chat with the message, so only admins change them in groups
+func handleSettingsCallback(ctx context.Context, cq *tgbotapi.CallbackQuery, arg string) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		return ErrCantParseCtx
+	}
+	if !canChangeChatSettings(cq) {
+		callbackAnswer(cq.ID, ErrNotChatAdmin.Error())
+		return nil
+	}
+	chatID := cq.Message.Chat.ID
+	action, value, _ := strings.Cut(arg, ":")
+
+	var answer string
+	switch action {
+	case "inc", "dec":
+		step := 1
+		if action == "dec" {
+			step = -1
+		}
+		gpc := personGenerateConfig(ctx, st, chatID)
+		n, ok := stepWords(gpc, step)
+		if !ok {
+			callbackAnswer(cq.ID, "Can't change the number of words anymore")
+			return nil
+		}
+		err := updateSettings(ctx, st, chatID, func(s *Settings) {
+			if gpc.mnemonic != 0 {
+				s.Mnemonic = n
+				return
+			}
+			// Fixed number of words replaces the target strength
+			s.Words = n
+			s.TargetBits = 0
+		})
+		if err != nil {
+			return err
+		}
+		answer = fmt.Sprintf("%d words", n)
+
+	case "sep":
+		i := ParseInt(value)
+		if i < 0 || i >= len(separatorPresets) {
+			return ErrUnknownSetting
+		}
+		p := separatorPresets[i]
+		if p.sep == currentSeparator(ctx, st, chatID) {
+			callbackAnswer(cq.ID, "This separator is already chosen")
+			return nil
+		}
+		if err := updateSettings(ctx, st, chatID, func(s *Settings) { s.Separator = p.sep }); err != nil {
+			return err
+		}
+		answer = fmt.Sprintf("Separator is %s", p.name)
+
+	case "wl":
+		if value == "" {
+			// Show the wordlists in the same message.
+			// Wordlists uploaded by people are personal, so they aren't offered in groups
+			var custom *Wordlist
+			if !isGroup(cq.Message.Chat) {
+				if ul, err := st.UserList(ctx, chatID); err == nil {
+					custom = ul.Wordlist()
+				}
+			}
+			s, err := st.Settings(ctx, chatID)
+			if err != nil {
+				return err
+			}
+			ec := tgbotapi.NewEditMessageReplyMarkup(chatID, cq.Message.MessageID, IKBSettingsWordlists(s.Wordlist, custom))
+			if _, err := bot.Request(ec); err != nil {
+				return err
+			}
+			callbackAnswer(cq.ID, "")
+			return nil
+		}
+		wl := WL(value)
+		if _, ok := Wordlists[wl]; !ok && (wl != userwl || isGroup(cq.Message.Chat)) {
+			return ErrUnknownSetting
+		}
+		if err := updateSettings(ctx, st, chatID, func(s *Settings) { s.Wordlist = wl }); err != nil {
+			return err
+		}
+		_, custom := personWordlist(ctx, st, chatID, wl)
+		if custom != nil {
+			answer = fmt.Sprintf("%s is the new wordlist", custom.Name())
+		} else {
+			answer = fmt.Sprintf("%s is the new wordlist", wl.ShortName())
+		}
+
+	case "back":
+		// The message with settings is shown again below
+
+	case "reset":
+		if err := st.DeleteSettings(ctx, chatID); err != nil {
+			return err
+		}
+		answer = "Settings are reset to defaults"
+		logger.Info("Reset settings of chat", zap.Int64("chatid", chatID))
+
+	default:
+		return ErrUnknownSetting
+	}
+
+	ec := tgbotapi.NewEditMessageTextAndMarkup(chatID, cq.Message.MessageID, settingsText(ctx, st, chatID), IKBSettings(currentSeparator(ctx, st, chatID)))
+	ec.ParseMode = tgbotapi.ModeHTML
+	if _, err := bot.Request(ec); err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		return err
+	}
+	callbackAnswer(cq.ID, answer)
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	defStoragePath  = "passphrasebot.json" // File of the file storage if the path isn't set
+	defRedisAddress = "redis:6379"         // Address of Redis if PASSPHRASEBOT_REDIS isn't set
+	settingsVersion = 1                    // Version of the layout of settings
+	settingsTTL     = 365 * 24 * time.Hour // To free some memory after a year without use
+)
+
+var (
+	ErrUnknownStorage = errors.New("Unknown storage, use redis, memory or file")
+	ErrInvalidWL      = errors.New("ListID is invalid")
+	ErrNoUserList     = errors.New("User's wordlist is not found")
+	ErrSettingsNewer  = errors.New("Settings are saved by a newer version of the bot")
+)
+
+// Storage keeps settings of chats, state of conversations, own policies
+// and wordlists of people and messages waiting for deletion.
+// Operations are cancelled with ctx, usually the context of the update.
+// The vault is still kept in Redis
+type Storage interface {
+	// Settings of generation of the chat. Defaults are returned for a new chat
+	Settings(ctx context.Context, chatID int64) (Settings, error)
+	SaveSettings(ctx context.Context, chatID int64, s Settings) error
+	// DeleteSettings resets settings of the chat to the defaults
+	DeleteSettings(ctx context.Context, chatID int64) error
+
+	// Last action is the command that waits for text of the person.
+	// It's forgotten after an hour. Empty string is returned if there is none
+	LastAction(ctx context.Context, personID int64) (LastAction, error)
+	LastActionArg(ctx context.Context, personID int64) (string, error)
+	SetLastAction(ctx context.Context, personID int64, la LastAction) error
+	SetLastActionArg(ctx context.Context, personID int64, arg string) error
+	DeleteLastAction(ctx context.Context, personID int64) error
+
+	// Policies defined by the person, sorted by name
+	UserPolicies(ctx context.Context, personID int64) ([]Policy, error)
+	UserPolicy(ctx context.Context, personID int64, id string) (Policy, error)
+	SaveUserPolicy(ctx context.Context, personID int64, p Policy) error
+	// DeleteUserPolicy deletes the policy. If the policy is chosen
+	// at the moment, the person stays without policy
+	DeleteUserPolicy(ctx context.Context, personID int64, id string) error
+
+	// Wordlist uploaded by the person. ErrNoUserList is returned if there is none
+	UserList(ctx context.Context, personID int64) (UserWordlist, error)
+	SaveUserList(ctx context.Context, personID int64, ul UserWordlist) error
+
+	// Messages that have to be deleted after their time
+	ScheduleDeletion(ctx context.Context, d ScheduledDeletion, at time.Time) error
+	DueDeletions(ctx context.Context, now time.Time) ([]ScheduledDeletion, error)
+	DeleteScheduledDeletion(ctx context.Context, d ScheduledDeletion) error
+}
+
+// Settings of generation of the chat. In private chats they are settings of the person.
+// They are loaded and saved as one record
+type Settings struct {
+	Version         int       `json:"version" redis:"v"`
+	Wordlist        WL        `json:"wordlist" redis:"wl"`
+	Words           int       `json:"words" redis:"words"`
+	Separator       string    `json:"separator" redis:"sep"`
+	TargetBits      int       `json:"target_bits,omitempty" redis:"bits"` // Number of words is computed from it if it isn't 0
+	Transform       Transform `json:"transform,omitempty" redis:"trans"`
+	PolicyID        string    `json:"policy,omitempty" redis:"policy"`
+	Mnemonic        int       `json:"mnemonic,omitempty" redis:"bip39"`       // Number of words of BIP39 mnemonics, 0 if the mode is off
+	SelfDestruct    int       `json:"self_destruct,omitempty" redis:"ttl"`    // Lifetime of messages in minutes, 0 if they aren't deleted
+	PrivateDelivery bool      `json:"private_delivery,omitempty" redis:"gdm"` // Passphrases of the group are sent to private chats
+}
+
+// defaultSettings returns settings of a new chat
+func defaultSettings() Settings {
+	return Settings{
+		Version:   settingsVersion,
+		Wordlist:  defwl,
+		Words:     deflen,
+		Separator: defsep,
+	}
+}
+
+// upgradeSettings converts settings saved with an older layout.
+// Settings of a newer bot aren't changed, so they aren't lost after a rollback
+func upgradeSettings(s Settings) (Settings, error) {
+	if s.Version > settingsVersion {
+		return s, ErrSettingsNewer
+	}
+	// Version 1 is the first one. Changes of the layout are converted here
+	s.Version = settingsVersion
+	return s, nil
+}
+
+// resetSettings returns the defaults for the chat. Delivery of the group
+// isn't a setting of generation, so it's kept
+func resetSettings(s Settings) Settings {
+	d := defaultSettings()
+	d.PrivateDelivery = s.PrivateDelivery
+	return d
+}
+
+// Validate checks that the settings can be saved
+func (s Settings) Validate() error {
+	// Lists aren't checked with the registry, a list that isn't loaded
+	// is replaced with the default one during generation
+	if s.Wordlist != userwl && !wlIDPattern.MatchString(string(s.Wordlist)) {
+		return ErrInvalidWL
+	}
+	if s.Words <= 0 {
+		return ErrNumberOfWordsLessThanZero
+	}
+	if s.Words > maxlen {
+		return ErrNumberOfWordsTooBig
+	}
+	if s.Transform&^transAll != 0 {
+		return ErrUnknownTransform
+	}
+	if s.Mnemonic != 0 && !validMnemonicLength(s.Mnemonic) {
+		return ErrMnemonicLength
+	}
+	if !validTTL(s.SelfDestruct) {
+		return ErrInvalidTTL
+	}
+	return nil
+}
+
+// StorageFunc returns storage for the goroutine with its own redis connection.
+// Redis storage uses the connection, the other ones are shared and don't need Redis
+type StorageFunc func(conn RedisConn) Storage
+
+// storageFromEnv opens the storage chosen with PASSPHRASEBOT_STORAGE:
+// redis (default), memory or file. File storage is kept
+// in PASSPHRASEBOT_STORAGE_PATH. Redis is connected only in redis mode,
+// the pool is nil otherwise. Old settings in Redis are migrated
+func storageFromEnv() (*redis.Pool, StorageFunc, error) {
+	switch os.Getenv("PASSPHRASEBOT_STORAGE") {
+	case "", "redis":
+		pool := NewRedisPool(redisAddress())
+		conn := NewConn(pool)
+		defer conn.Close()
+		if err := migrateSettings(conn); err != nil {
+			pool.Close()
+			return nil, nil, err
+		}
+		return pool, func(conn RedisConn) Storage { return NewRedisStorage(conn) }, nil
+	case "memory":
+		st := NewMemoryStorage()
+		return nil, func(RedisConn) Storage { return st }, nil
+	case "file":
+		path := os.Getenv("PASSPHRASEBOT_STORAGE_PATH")
+		if path == "" {
+			path = defStoragePath
+		}
+		st, err := NewFileStorage(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, func(RedisConn) Storage { return st }, nil
+	}
+	return nil, nil, ErrUnknownStorage
+}
+
+// redisAddress returns address of Redis from PASSPHRASEBOT_REDIS,
+// the Redis service of docker compose by default
+func redisAddress() string {
+	if addr := os.Getenv("PASSPHRASEBOT_REDIS"); addr != "" {
+		return addr
+	}
+	return defRedisAddress
+}
+
+// redisStorage keeps settings of every chat in one hash
+type redisStorage struct {
+	conn RedisConn
+}
+
+func NewRedisStorage(conn RedisConn) Storage {
+	return redisStorage{conn: conn}
+}
+
+// with returns the connection whose operations are cancelled with ctx
+func (r redisStorage) with(ctx context.Context) RedisConn {
+	return r.conn.WithContext(ctx)
+}
+
+func (r redisStorage) Settings(ctx context.Context, chatID int64) (Settings, error) {
+	s, ok, err := r.with(ctx).NewRedisGetRequest().ID(chatID).GetSettings()
+	if err != nil || !ok {
+		return defaultSettings(), err
+	}
+	return upgradeSettings(s)
+}
+
+func (r redisStorage) SaveSettings(ctx context.Context, chatID int64, s Settings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	s.Version = settingsVersion
+	return r.with(ctx).NewRedisSetRequest().SetSettings(chatID, s)
+}
+
+func (r redisStorage) DeleteSettings(ctx context.Context, chatID int64) error {
+	s, err := r.Settings(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	return r.SaveSettings(ctx, chatID, resetSettings(s))
+}
+
+func (r redisStorage) LastAction(ctx context.Context, personID int64) (LastAction, error) {
+	la, err := r.with(ctx).NewRedisGetRequest().ID(personID).GetLastAction()
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return la, err
+}
+
+func (r redisStorage) LastActionArg(ctx context.Context, personID int64) (string, error) {
+	arg, err := r.with(ctx).NewRedisGetRequest().ID(personID).GetLastActionArg()
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return arg, err
+}
+
+func (r redisStorage) SetLastAction(ctx context.Context, personID int64, la LastAction) error {
+	return r.with(ctx).NewRedisSetRequest().SetLastAction(personID, la)
+}
+
+func (r redisStorage) SetLastActionArg(ctx context.Context, personID int64, arg string) error {
+	return r.with(ctx).NewRedisSetRequest().SetLastActionArg(personID, arg)
+}
+
+func (r redisStorage) DeleteLastAction(ctx context.Context, personID int64) error {
+	return r.with(ctx).NewRedisDelRequest().ID(personID).DeleteLastAction()
+}
+
+func (r redisStorage) UserPolicies(ctx context.Context, personID int64) ([]Policy, error) {
+	return r.with(ctx).NewRedisGetRequest().ID(personID).GetUserPolicies()
+}
+
+func (r redisStorage) UserPolicy(ctx context.Context, personID int64, id string) (Policy, error) {
+	return r.with(ctx).NewRedisGetRequest().ID(personID).GetUserPolicy(id)
+}
+
+func (r redisStorage) SaveUserPolicy(ctx context.Context, personID int64, p Policy) error {
+	return r.with(ctx).NewRedisSetRequest().SetUserPolicy(personID, p)
+}
+
+func (r redisStorage) DeleteUserPolicy(ctx context.Context, personID int64, id string) error {
+	if err := r.with(ctx).NewRedisDelRequest().ID(personID).DeleteUserPolicy(id); err != nil {
+		return err
+	}
+
+	s, err := r.Settings(ctx, personID)
+	if err != nil || s.PolicyID != id {
+		return err
+	}
+	s.PolicyID = ""
+	return r.SaveSettings(ctx, personID, s)
+}
+
+func (r redisStorage) UserList(ctx context.Context, personID int64) (UserWordlist, error) {
+	ul, err := r.with(ctx).NewRedisGetRequest().ID(personID).GetUserList()
+	if err == redis.ErrNil {
+		return ul, ErrNoUserList
+	}
+	return ul, err
+}
+
+func (r redisStorage) SaveUserList(ctx context.Context, personID int64, ul UserWordlist) error {
+	return r.with(ctx).NewRedisSetRequest().SetUserList(personID, ul)
+}
+
+func (r redisStorage) ScheduleDeletion(ctx context.Context, d ScheduledDeletion, at time.Time) error {
+	return r.with(ctx).NewRedisSetRequest().ScheduleDeletion(d, at)
+}
+
+func (r redisStorage) DueDeletions(ctx context.Context, now time.Time) ([]ScheduledDeletion, error) {
+	return r.with(ctx).NewRedisGetRequest().GetDueDeletions(now)
+}
+
+func (r redisStorage) DeleteScheduledDeletion(ctx context.Context, d ScheduledDeletion) error {
+	return r.with(ctx).NewRedisDelRequest().DeleteScheduledDeletion(d)
+}
+
+// updateSettings changes settings of the chat with f and saves them
+func updateSettings(ctx context.Context, st Storage, chatID int64, f func(s *Settings)) error {
+	s, err := st.Settings(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	f(&s)
+	return st.SaveSettings(ctx, chatID, s)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testSettings() Settings {
+	return Settings{
+		Wordlist:        bip39wl,
+		Words:           5,
+		Separator:       "_",
+		Transform:       TransTitle,
+		Mnemonic:        12,
+		SelfDestruct:    5,
+		PrivateDelivery: true,
+	}
+}
+
+// testStorageRoundTrip saves data of one person and checks that it's read back
+func testStorageRoundTrip(t *testing.T, st Storage) {
+	t.Helper()
+	ctx := context.Background()
+
+	want := testSettings()
+	if err := st.SaveSettings(ctx, 1, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := st.Settings(ctx, 1)
+	want.Version = settingsVersion
+	if err != nil || got != want {
+		t.Fatalf("got %+v, %v, want %+v", got, err, want)
+	}
+	if err := st.SaveSettings(ctx, 1, Settings{Wordlist: "not a list", Words: 3}); !errors.Is(err, ErrInvalidWL) {
+		t.Errorf("invalid settings are saved: %v", err)
+	}
+
+	p := Policy{ID: "site", Name: "site", MaxLen: 32}
+	if err := st.SaveUserPolicy(ctx, 1, p); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := st.UserPolicy(ctx, 1, "site"); err != nil || got.Name != p.Name {
+		t.Errorf("got policy %+v, %v", got, err)
+	}
+
+	if _, err := st.UserList(ctx, 1); !errors.Is(err, ErrNoUserList) {
+		t.Errorf("got %v for missing list", err)
+	}
+	ul := UserWordlist{Name: "mine", Words: []string{"one", "two"}}
+	if err := st.SaveUserList(ctx, 1, ul); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := st.UserList(ctx, 1); err != nil || got.Name != ul.Name || len(got.Words) != 2 {
+		t.Errorf("got list %+v, %v", got, err)
+	}
+
+	d := ScheduledDeletion{ChatID: 1, MessageID: 7}
+	if err := st.ScheduleDeletion(ctx, d, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if due, err := st.DueDeletions(ctx, time.Now()); err != nil || len(due) != 1 || due[0] != d {
+		t.Errorf("got due deletions %v, %v", due, err)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorageRoundTrip(t, NewMemoryStorage())
+}
+
+func TestFileStorage(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	st, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorageRoundTrip(t, st)
+	if err := st.SetLastAction(ctx, 1, laSetNubmer); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything except last actions survives the restart
+	st, err = NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testSettings()
+	want.Version = settingsVersion
+	if got, err := st.Settings(ctx, 1); err != nil || got != want {
+		t.Errorf("got %+v, %v, want %+v", got, err, want)
+	}
+	if _, err := st.UserPolicy(ctx, 1, "site"); err != nil {
+		t.Errorf("policy is lost: %v", err)
+	}
+	if _, err := st.UserList(ctx, 1); err != nil {
+		t.Errorf("list is lost: %v", err)
+	}
+	if la, err := st.LastAction(ctx, 1); err != nil || la != "" {
+		t.Errorf("got last action %q, %v", la, err)
+	}
+}
+
+func TestMemoryStorageLastAction(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStorage()
+
+	if err := st.SetLastAction(ctx, 1, laSetNubmer); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SetLastActionArg(ctx, 1, "arg"); err != nil {
+		t.Fatal(err)
+	}
+	if la, err := st.LastAction(ctx, 1); err != nil || la != laSetNubmer {
+		t.Errorf("got last action %q, %v", la, err)
+	}
+	if arg, err := st.LastActionArg(ctx, 1); err != nil || arg != "arg" {
+		t.Errorf("got arg %q, %v", arg, err)
+	}
+
+	// The hour is over
+	la := st.data.LastActions[1]
+	la.Expires = time.Now().Add(-time.Second)
+	st.data.LastActions[1] = la
+	if la, err := st.LastAction(ctx, 1); err != nil || la != "" {
+		t.Errorf("got expired last action %q, %v", la, err)
+	}
+	if arg, err := st.LastActionArg(ctx, 1); err != nil || arg != "" {
+		t.Errorf("got expired arg %q, %v", arg, err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// AttackModel describes how fast the attacker can check guesses
+type AttackModel struct {
+	Name             string
+	GuessesPerSecond float64
+}
+
+// AttackModels are used to estimate crack time of the passphrase
+var AttackModels = []AttackModel{
+	{Name: "Online, throttled", GuessesPerSecond: 100.0 / 3600},
+	{Name: "Offline, slow hash", GuessesPerSecond: 1e4},
+	{Name: "Offline, fast hash", GuessesPerSecond: 1e10},
+}
+
+// CrackTime is the average time needed to guess the passphrase with the model
+type CrackTime struct {
+	Model   AttackModel
+	Seconds float64
+}
+
+// Strength of the passphrase generated with the config
+type Strength struct {
+	Bits       float64
+	CrackTimes []CrackTime
+	Policy     string // Name of the policy, empty if there is none
+}
+
+// Entropy returns entropy of the future passphrase in bits.
+// It's 0 if the config is not valid
+func (gpc *GeneratePasswordConfig) Entropy() float64 {
+	if gpc.mnemonic > 0 {
+		return float64(MnemonicEntropyBits(gpc.mnemonic))
+	}
+	return gpc.entropy(gpc.WordCount())
+}
+
+// entropy returns entropy in bits of the passphrase of n words
+// including the transformations
+func (gpc *GeneratePasswordConfig) entropy(n int) float64 {
+	if !gpc.Valid() || n < 1 {
+		return 0
+	}
+	gp, err := gpc.plan()
+	if err != nil {
+		return 0
+	}
+	return gp.bits(n)
+}
+
+// Strength returns entropy of the future passphrase and
+// estimated crack times for every model from AttackModels
+func (gpc *GeneratePasswordConfig) Strength() Strength {
+	s := StrengthOf(gpc.Entropy())
+	if gpc.policy != nil && gpc.mnemonic == 0 {
+		s.Policy = gpc.policy.Name
+	}
+	return s
+}
+
+// StrengthOf returns estimated crack times of the passphrase with entropy of bits
+func StrengthOf(bits float64) Strength {
+	s := Strength{Bits: bits}
+	for _, m := range AttackModels {
+		// On average half of the combinations are checked before success
+		s.CrackTimes = append(s.CrackTimes, CrackTime{
+			Model:   m,
+			Seconds: math.Exp2(s.Bits-1) / m.GuessesPerSecond,
+		})
+	}
+	return s
+}
+
+// humanDuration returns rough duration like "3 days" or "10^12 years"
+func humanDuration(sec float64) string {
+	const (
+		minute = 60
+		hour   = 60 * minute
+		day    = 24 * hour
+		year   = 365 * day
+	)
+
+	plural := func(n float64, unit string) string {
+		if int64(n) == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", int64(n), unit)
+	}
+
+	switch {
+	case sec < 1:
+		return "less than a second"
+	case sec < minute:
+		return plural(sec, "second")
+	case sec < hour:
+		return plural(sec/minute, "minute")
+	case sec < day:
+		return plural(sec/hour, "hour")
+	case sec < year:
+		return plural(sec/day, "day")
+	case sec < 10000*year:
+		return plural(sec/year, "year")
+	case math.IsInf(sec, 1):
+		return "forever"
+	}
+	return fmt.Sprintf("10^%d years", int(math.Log10(sec/year)))
+}
+
+// passphraseText returns HTML text of the message with the passphrase and its strength
+func passphraseText(passphrase string, s Strength) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("<code>%s</code>\n\n", tgbotapi.EscapeText(tgbotapi.ModeHTML, passphrase)))
+	if s.Policy != "" {
+		sb.WriteString(fmt.Sprintf("Policy: %s\n", tgbotapi.EscapeText(tgbotapi.ModeHTML, s.Policy)))
+	}
+	sb.WriteString(fmt.Sprintf("Entropy: <b>%.1f bits</b>\nTime to crack:", s.Bits))
+	for _, ct := range s.CrackTimes {
+		sb.WriteString(fmt.Sprintf("\n• %s: %s", ct.Model.Name, humanDuration(ct.Seconds)))
+	}
+	return sb.String()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStrengthOf(t *testing.T) {
+	tests := []struct {
+		bits    float64
+		seconds []float64 // For every model of AttackModels
+	}{
+		{1, []float64{36, 1e-4, 1e-10}},
+		{11, []float64{36864, 0.1024, 1.024e-7}},
+		{41, []float64{1099511627776 * 36, 109951162.7776, 109.9511627776}},
+	}
+	for _, tt := range tests {
+		s := StrengthOf(tt.bits)
+		if s.Bits != tt.bits || len(s.CrackTimes) != len(AttackModels) {
+			t.Fatalf("%v bits: got %+v", tt.bits, s)
+		}
+		for i, ct := range s.CrackTimes {
+			if math.Abs(ct.Seconds-tt.seconds[i]) > tt.seconds[i]*1e-9 {
+				t.Errorf("%v bits, %s: got %v seconds, want %v", tt.bits, ct.Model.Name, ct.Seconds, tt.seconds[i])
+			}
+		}
+	}
+}
+
+func TestHumanDuration(t *testing.T) {
+	const year = 365 * 24 * 3600
+	tests := []struct {
+		sec  float64
+		want string
+	}{
+		{0.5, "less than a second"},
+		{1, "1 second"},
+		{59, "59 seconds"},
+		{60, "1 minute"},
+		{2 * 3600, "2 hours"},
+		{3 * 24 * 3600, "3 days"},
+		{year, "1 year"},
+		{9999 * year, "9999 years"},
+		{1e4 * year, "10^4 years"},
+		{3e12 * year, "10^12 years"},
+		{math.Inf(1), "forever"},
+	}
+	for _, tt := range tests {
+		if got := humanDuration(tt.sec); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.sec, got, tt.want)
+		}
+	}
+}
+
+func TestConfigStrength(t *testing.T) {
+	loadBIP39Wordlist(t)
+	tests := []struct {
+		name string
+		gpc  *GeneratePasswordConfig
+		bits float64
+	}{
+		{"4 BIP39 words", NewGeneratePasswordConfig().Wordlist(bip39wl).Length(4), 44},
+		{"5 words of 8", NewGeneratePasswordConfig().UserWordlist(testWordlist("a", "b", "c", "d", "e", "f", "g", "h")).Length(5), 15},
+		{"12 words mnemonic", NewGeneratePasswordConfig().Mnemonic(12), 128},
+		{"unknown wordlist", NewGeneratePasswordConfig().Wordlist("missing").Length(4), 0},
+	}
+	for _, tt := range tests {
+		s := tt.gpc.Strength()
+		if math.Abs(s.Bits-tt.bits) > 1e-9 {
+			t.Errorf("%s: got %v bits, want %v", tt.name, s.Bits, tt.bits)
+		}
+	}
+
+	p := &Policy{Name: "site"}
+	if s := NewGeneratePasswordConfig().Wordlist(bip39wl).Policy(p).Strength(); s.Policy != "site" {
+		t.Errorf("got policy %q", s.Policy)
+	}
+}
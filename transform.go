@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Transform is a set of changes applied to the words of the passphrase
+type Transform uint8
+
+const (
+	TransTitle     Transform = 1 << iota // Every word starts with a capital letter
+	TransUpperWord                       // One random word is upper-cased
+	TransDigit                           // A random digit is added after a random word
+	TransSymbol                          // A random symbol is appended to the passphrase
+
+	transAll = TransTitle | TransUpperWord | TransDigit | TransSymbol
+)
+
+// transSymbols are symbols accepted by most of the password policies
+const transSymbols = "!#$%&*+-=?@^_~"
+
+// transAlphabet contains characters that transformations can add.
+// Policies remove banned characters from it
+type transAlphabet struct {
+	digits  string
+	symbols string
+}
+
+var defAlphabet = transAlphabet{digits: "0123456789", symbols: transSymbols}
+
+var ErrUnknownTransform = errors.New("Unknown transformation")
+
+// transformOption is one of the options of the /transform keyboard
+type transformOption struct {
+	t    Transform
+	id   string // Used in callback data
+	name string
+}
+
+var transformOptions = []transformOption{
+	{TransTitle, "title", "Title Case"},
+	{TransUpperWord, "upper", "One word UPPER"},
+	{TransDigit, "digit", "Random digit"},
+	{TransSymbol, "symbol", "Random symbol"},
+}
+
+// Has reports whether every transformation of o is in t
+func (t Transform) Has(o Transform) bool {
+	return t&o == o
+}
+
+// Bits returns entropy in bits added by transformations to the passphrase of n words.
+// Title Case is deterministic, so it doesn't add anything
+func (t Transform) Bits(n int, a transAlphabet) float64 {
+	var bits float64
+	if t.Has(TransUpperWord) && n > 1 {
+		bits += math.Log2(float64(n))
+	}
+	if t.Has(TransDigit) && a.digits != "" {
+		bits += math.Log2(float64(len(a.digits) * n))
+	}
+	if t.Has(TransSymbol) && a.symbols != "" {
+		bits += math.Log2(float64(len(a.symbols)))
+	}
+	return bits
+}
+
+// Apply changes the words with the transformations.
+// Every random choice is made with crypto/rand
+func (t Transform) Apply(parts []string, a transAlphabet) error {
+	if len(parts) == 0 {
+		return nil
+	}
+
+	if t.Has(TransTitle) {
+		for i, p := range parts {
+			if p == "" {
+				continue
+			}
+			r, size := utf8.DecodeRuneInString(p)
+			parts[i] = string(unicode.ToUpper(r)) + p[size:]
+		}
+	}
+	if t.Has(TransUpperWord) {
+		i, err := randInt(len(parts))
+		if err != nil {
+			return err
+		}
+		parts[i] = strings.ToUpper(parts[i])
+	}
+	if t.Has(TransDigit) && a.digits != "" {
+		i, err := randInt(len(parts))
+		if err != nil {
+			return err
+		}
+		d, err := randInt(len(a.digits))
+		if err != nil {
+			return err
+		}
+		parts[i] += string(a.digits[d])
+	}
+	if t.Has(TransSymbol) && a.symbols != "" {
+		s, err := randInt(len(a.symbols))
+		if err != nil {
+			return err
+		}
+		parts[len(parts)-1] += string(a.symbols[s])
+	}
+	return nil
+}
+
+// randInt returns uniform random number in [0, n)
+func randInt(n int) (int, error) {
+	rnd, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(rnd.Int64()), nil
+}
+
+// transformsText returns text of the /transform message
+func transformsText() string {
+	return "<b>Transformations</b>\n\nSome sites reject passphrases without capital letters, digits or symbols. Toggle the options below, they are applied to every new passphrase and counted in its strength."
+}
+
+// handleTransformCallback toggles the transformation of the chat and updates the keyboard
+func handleTransformCallback(ctx context.Context, cq *tgbotapi.CallbackQuery, id string) error {
+	st, ok := ctx.Value("storage").(Storage)
+	if !ok {
+		return ErrCantParseCtx
+	}
+
+	var opt *transformOption
+	for i := range transformOptions {
+		if transformOptions[i].id == id {
+			opt = &transformOptions[i]
+		}
+	}
+	if opt == nil {
+		return ErrUnknownTransform
+	}
+
+	chatID := cq.Message.Chat.ID
+	if !canChangeChatSettings(cq) {
+		callbackAnswer(cq.ID, ErrNotChatAdmin.Error())
+		return nil
+	}
+
+	s, err := st.Settings(ctx, chatID)
+	if err != nil {
+		return err
+	}
+	s.Transform ^= opt.t
+	if err := st.SaveSettings(ctx, chatID, s); err != nil {
+		return err
+	}
+	t := s.Transform
+
+	ec := tgbotapi.NewEditMessageReplyMarkup(chatID, cq.Message.MessageID, IKBTransforms(t))
+	if _, err := bot.Request(ec); err != nil {
+		return err
+	}
+
+	if t.Has(opt.t) {
+		callbackAnswer(cq.ID, opt.name+" is on")
+	} else {
+		callbackAnswer(cq.ID, opt.name+" is off")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestTransformBits(t *testing.T) {
+	tests := []struct {
+		name string
+		t    Transform
+		n    int
+		a    transAlphabet
+		want float64
+	}{
+		{"none", 0, 4, defAlphabet, 0},
+		{"title", TransTitle, 4, defAlphabet, 0},
+		{"upper word", TransUpperWord, 4, defAlphabet, 2},
+		{"upper in one word", TransUpperWord, 1, defAlphabet, 0},
+		{"digit", TransDigit, 4, defAlphabet, math.Log2(40)},
+		{"digit without digits", TransDigit, 4, transAlphabet{symbols: transSymbols}, 0},
+		{"symbol", TransSymbol, 4, defAlphabet, math.Log2(14)},
+		{"symbol of 2", TransSymbol, 4, transAlphabet{symbols: "!?"}, 1},
+		{"all", transAll, 4, defAlphabet, 2 + math.Log2(40) + math.Log2(14)},
+	}
+	for _, tt := range tests {
+		if got := tt.t.Bits(tt.n, tt.a); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %v bits, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTransformEntropy(t *testing.T) {
+	wl := wordlist1024()
+	tests := []struct {
+		name string
+		t    Transform
+		want float64 // Entropy of 3 words
+	}{
+		{"none", 0, 30},
+		{"title", TransTitle, 30},
+		{"upper word", TransUpperWord, 30 + math.Log2(3)},
+		{"digit and symbol", TransDigit | TransSymbol, 30 + math.Log2(30) + math.Log2(14)},
+	}
+	for _, tt := range tests {
+		gpc := NewGeneratePasswordConfig().UserWordlist(wl).Length(3).Transform(tt.t)
+		if got := gpc.Entropy(); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %v bits, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTransformApply(t *testing.T) {
+	parts := []string{"one", "two", "three"}
+	if err := (TransTitle | TransDigit | TransSymbol).Apply(parts, defAlphabet); err != nil {
+		t.Fatal(err)
+	}
+	joined := strings.Join(parts, "")
+	digits := strings.IndexFunc(joined, unicode.IsDigit)
+	if digits < 0 || strings.Count(joined, string(joined[digits])) != 1 {
+		t.Errorf("%q: want one digit", parts)
+	}
+	for _, p := range parts {
+		if !unicode.IsUpper(rune(p[0])) {
+			t.Errorf("%q: %q isn't title case", parts, p)
+		}
+	}
+	if last := parts[2]; !strings.ContainsRune(transSymbols, rune(last[len(last)-1])) {
+		t.Errorf("%q: no symbol at the end", parts)
+	}
+
+	parts = []string{"one", "two", "three"}
+	if err := TransUpperWord.Apply(parts, defAlphabet); err != nil {
+		t.Fatal(err)
+	}
+	upper := 0
+	for _, p := range parts {
+		if p == strings.ToUpper(p) {
+			upper++
+		}
+	}
+	if upper != 1 {
+		t.Errorf("%q: got %d upper words", parts, upper)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	defWebhookListen = ":8443"
+	webhookMaxBody   = 1 << 20 // Updates are much smaller, bigger bodies are rejected
+	webhookHeader    = "X-Telegram-Bot-Api-Secret-Token"
+)
+
+var ErrNoWebhookSecret = errors.New("PASSPHRASEBOT_WEBHOOK_SECRET has to be set in webhook mode")
+
+// webhookConfig is read from environment variables.
+// Webhook mode is used if PASSPHRASEBOT_WEBHOOK_URL is set
+type webhookConfig struct {
+	URL    string // Public URL, Telegram sends updates there
+	Listen string // Address of the HTTP server
+	Secret string // Telegram sends it in the header of every request
+	Cert   string // TLS certificate and key. Without them the server uses plain HTTP,
+	Key    string // for example behind a load balancer that terminates TLS
+}
+
+// webhookConfigFromEnv returns config of the webhook. false is returned in polling mode
+func webhookConfigFromEnv() (webhookConfig, bool) {
+	cfg := webhookConfig{
+		URL:    os.Getenv("PASSPHRASEBOT_WEBHOOK_URL"),
+		Listen: os.Getenv("PASSPHRASEBOT_WEBHOOK_LISTEN"),
+		Secret: os.Getenv("PASSPHRASEBOT_WEBHOOK_SECRET"),
+		Cert:   os.Getenv("PASSPHRASEBOT_WEBHOOK_CERT"),
+		Key:    os.Getenv("PASSPHRASEBOT_WEBHOOK_KEY"),
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = defWebhookListen
+	}
+	return cfg, cfg.URL != ""
+}
+
+// runPolling gets updates with long polling until the signal to stop
+func runPolling(workers *workerPool, stop <-chan os.Signal) {
+	// Telegram doesn't return updates while the webhook is set
+	if _, err := bot.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		logger.Warn("Can't delete webhook", zap.Error(err))
+	}
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	updates := bot.GetUpdatesChan(u)
+	logger.Info("Getting updates with long polling")
+
+	for {
+		select {
+		case upd, ok := <-updates:
+			if !ok {
+				return
+			}
+			workers.Dispatch(upd)
+		case <-stop:
+			bot.StopReceivingUpdates()
+			return
+		}
+	}
+}
+
+// webhookHandler checks the secret of the request and passes the update to the workers.
+// It can be tested locally by POSTing update JSON with the secret in the header
+func webhookHandler(secret string, workers *workerPool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(webhookHeader)), []byte(secret)) != 1 {
+			logger.Warn("Got webhook request with wrong secret", zap.String("remote", r.RemoteAddr))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, webhookMaxBody)
+		upd, err := bot.HandleUpdate(r)
+		if err != nil {
+			logger.Warn("Can't decode update", zap.Error(err))
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		workers.Dispatch(*upd)
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// setWebhook tells Telegram where to send updates. WebhookConfig
+// doesn't have the secret token, so the parameters are set manually
+func setWebhook(cfg webhookConfig) error {
+	params := make(tgbotapi.Params)
+	params["url"] = cfg.URL
+	params["secret_token"] = cfg.Secret
+	_, err := bot.MakeRequest("setWebhook", params)
+	return err
+}
+
+// runWebhook runs HTTP server that gets updates from Telegram until the signal to stop.
+// Only one replica can run: unlocked vault keys and pending saves, searches
+// and password changes live in the memory of the process
+func runWebhook(cfg webhookConfig, workers *workerPool, stop <-chan os.Signal) error {
+	if cfg.Secret == "" {
+		return ErrNoWebhookSecret
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return err
+	}
+	if err := setWebhook(cfg); err != nil {
+		return err
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, webhookHandler(cfg.Secret, workers))
+	srv := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		if cfg.Cert != "" {
+			errc <- srv.ListenAndServeTLS(cfg.Cert, cfg.Key)
+		} else {
+			errc <- srv.ListenAndServe()
+		}
+	}()
+	logger.Info("Getting updates with webhook", zap.String("listen", cfg.Listen), zap.String("path", path), zap.Bool("tls", cfg.Cert != ""))
+
+	select {
+	case err := <-errc:
+		return err
+	case <-stop:
+	}
+
+	// Requests that are already accepted are finished
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	userListMinWords = 100     // Minimal number of unique words in the uploaded list
+	userListMaxWords = 100000  // Maximal number of words in the uploaded list
+	userListMaxWord  = 32      // Maximal length of one word in characters
+	userListMaxSize  = 2 << 20 // Maximal size of the uploaded file in bytes
+	userListMaxName  = 32      // Maximal length of the list name in characters
+)
+
+var (
+	ErrUnsupportedListFile = errors.New("Only .txt and .json wordlists are supported")
+	ErrListFileTooBig      = errors.New("Wordlist file is too big")
+	ErrListNotUTF8         = errors.New("Wordlist is not valid UTF-8")
+	ErrListTooSmall        = errors.New("Wordlist has too few unique words")
+	ErrListTooBig          = errors.New("Wordlist has too many words")
+)
+
+// UserWordlist is the wordlist uploaded by the user
+type UserWordlist struct {
+	Name  string   `json:"name"`
+	Words []string `json:"words"`
+}
+
+// Wordlist returns the list in the same form as built-in wordlists
+func (ul UserWordlist) Wordlist() *Wordlist {
+	words := ul.Words
+	return &Wordlist{
+		size:        len(words),
+		words:       &words,
+		name:        ul.Name,
+		description: "Your own wordlist",
+	}
+}
+
+// ListValidationError describes why the uploaded list was rejected
+type ListValidationError struct {
+	Line   int // Number of the line or of the element in JSON array, starting from 1
+	Word   string
+	Reason string
+}
+
+func (e ListValidationError) Error() string {
+	return fmt.Sprintf("word %d (%q) %s", e.Line, e.Word, e.Reason)
+}
+
+// ListReport tells the user what was changed in the list during validation
+type ListReport struct {
+	Empty      int // Number of skipped empty lines
+	Duplicates int // Number of skipped duplicates
+}
+
+// parseWordlist parses .txt (one word per line, optionally prefixed
+// with dice numbers like in EFF lists) or .json (array of strings) file
+func parseWordlist(fileName string, data []byte) ([]string, error) {
+	if !utf8.Valid(data) {
+		return nil, ErrListNotUTF8
+	}
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		var words []string
+		if err := json.Unmarshal(data, &words); err != nil {
+			return nil, fmt.Errorf("Can't parse JSON array of strings: %w", err)
+		}
+		return words, nil
+
+	case ".txt":
+		lines := strings.Split(strings.TrimPrefix(string(data), "\ufeff"), "\n")
+		words := make([]string, 0, len(lines))
+		for _, line := range lines {
+			// Strip "11111\tabacus" dice numbers
+			if fields := strings.Fields(line); len(fields) == 2 && isDigits(fields[0]) {
+				line = fields[1]
+			}
+			words = append(words, line)
+		}
+		return words, nil
+	}
+
+	return nil, ErrUnsupportedListFile
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// validateWordlist normalises words to NFC, skips empty lines and duplicates
+// and checks length of the words and of the whole list
+func validateWordlist(raw []string) (words []string, report ListReport, err error) {
+	if len(raw) > userListMaxWords {
+		return nil, report, ErrListTooBig
+	}
+
+	seen := make(map[string]bool, len(raw))
+	words = make([]string, 0, len(raw))
+	for i, w := range raw {
+		w = norm.NFC.String(strings.TrimSpace(w))
+		if w == "" {
+			report.Empty++
+			continue
+		}
+		if utf8.RuneCountInString(w) > userListMaxWord {
+			return nil, report, ListValidationError{Line: i + 1, Word: w, Reason: fmt.Sprintf("is longer than %d characters", userListMaxWord)}
+		}
+		if strings.IndexFunc(w, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+			return nil, report, ListValidationError{Line: i + 1, Word: w, Reason: "contains spaces or control characters"}
+		}
+		if seen[w] {
+			report.Duplicates++
+			continue
+		}
+		seen[w] = true
+		words = append(words, w)
+	}
+
+	if len(words) < userListMinWords {
+		return nil, report, ErrListTooSmall
+	}
+
+	return words, report, nil
+}
+
+// listName returns the name of the list built from the file name
+func listName(fileName string) string {
+	name := strings.TrimSpace(strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName)))
+	if name == "" || name == "." {
+		name = "My list"
+	}
+	if utf8.RuneCountInString(name) > userListMaxName {
+		name = string([]rune(name)[:userListMaxName])
+	}
+	return name
+}
+
+// downloadDocument downloads the document sent by the user
+func downloadDocument(doc *tgbotapi.Document) ([]byte, error) {
+	if doc.FileSize > userListMaxSize {
+		return nil, ErrListFileTooBig
+	}
+
+	url, err := bot.GetFileDirectURL(doc.FileID)
+	if err != nil {
+		return nil, err
+	}
+
+	c := http.Client{
+		Timeout: 10 * time.Second,
+	}
+	res, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, userListMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > userListMaxSize {
+		return nil, ErrListFileTooBig
+	}
+	return data, nil
+}
+
+// handleAddListCommand asks the user to send the wordlist file
+func handleAddListCommand(ctx context.Context, personID int64) (msg tgbotapi.MessageConfig) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	if err := setLastAction(ctx, laAddList); err != nil {
+		logger.Error("Can't set last action", zap.Error(err))
+		msg.Text = "Error on the server side. Sorry."
+		return
+	}
+
+	msg.Text = fmt.Sprintf(`Send me your wordlist as a document:
+• <b>.txt</b> with one word per line (EFF dice numbers before words are ignored)
+• <b>.json</b> with an array of strings
+
+The list has to contain at least %d unique words, each up to %d characters without spaces. Empty lines and duplicates are skipped. The new list replaces your previous one and appears in /list`, userListMinWords, userListMaxWord)
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = IKBCancelAction
+	return
+}
+
+// handleListDocument validates the wordlist sent by the user and stores it
+func handleListDocument(ctx context.Context, st Storage, personID int64, doc *tgbotapi.Document) (msg tgbotapi.MessageConfig, err error) {
+	msg = tgbotapi.NewMessage(personID, "")
+	msg.ReplyMarkup = IKBCancelAction
+
+	data, err := downloadDocument(doc)
+	if err != nil {
+		if errors.Is(err, ErrListFileTooBig) {
+			msg.Text = fmt.Sprintf("The file has to be less than %d KiB", userListMaxSize>>10)
+			return msg, err
+		}
+		msg.Text = "Can't download the file. Try again."
+		return msg, err
+	}
+
+	raw, err := parseWordlist(doc.FileName, data)
+	if err != nil {
+		msg.Text = fmt.Sprintf("Can't read the wordlist: %s", err)
+		return msg, err
+	}
+
+	words, report, err := validateWordlist(raw)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrListTooSmall):
+			msg.Text = fmt.Sprintf("The list has to contain at least %d unique words", userListMinWords)
+		case errors.Is(err, ErrListTooBig):
+			msg.Text = fmt.Sprintf("The list has to contain less than %d words", userListMaxWords)
+		default:
+			msg.Text = fmt.Sprintf("The list is invalid: %s", err)
+		}
+		return msg, err
+	}
+
+	ul := UserWordlist{Name: listName(doc.FileName), Words: words}
+	if err = st.SaveUserList(ctx, personID, ul); err != nil {
+		msg.Text = "Can't save the wordlist. Sorry."
+		return msg, err
+	}
+	if err = updateSettings(ctx, st, personID, func(s *Settings) { s.Wordlist = userwl }); err != nil {
+		logger.Error("Can't set person's list", zap.Error(err))
+	}
+
+	msg.Text = fmt.Sprintf("Wordlist <b>%s</b> with %d words is saved and selected.", tgbotapi.EscapeText(tgbotapi.ModeHTML, ul.Name), len(words))
+	if report.Empty > 0 || report.Duplicates > 0 {
+		msg.Text += fmt.Sprintf("\nSkipped %d empty lines and %d duplicates.", report.Empty, report.Duplicates)
+	}
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = genButton()
+	logger.Info("Added user's wordlist", zap.Int64("personid", personID), zap.Int("words", len(words)))
+	return msg, nil
+}
+
+// personWordlist returns the wordlist wl chosen by the person.
+// If the person has chosen own wordlist, it is loaded from the storage.
+// The default list is returned if the chosen one isn't loaded
+func personWordlist(ctx context.Context, st Storage, personID int64, wl WL) (WL, *Wordlist) {
+	if wl != userwl {
+		if _, ok := Wordlists[wl]; !ok {
+			logger.Warn("Wordlist isn't loaded, the default one is used", zap.String("wordlist", string(wl)), zap.Int64("personid", personID))
+			return defwl, nil
+		}
+		return wl, nil
+	}
+
+	ul, err := st.UserList(ctx, personID)
+	if err != nil {
+		logger.Warn("Can't get user's wordlist", zap.Error(err), zap.Int64("personid", personID))
+		return defwl, nil
+	}
+	return wl, ul.Wordlist()
+}
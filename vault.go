@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+)
+
+// Parameters of the Argon2id key derivation function.
+// 64 MiB of memory per derivation makes brute forcing
+// of weak encryption passwords expensive on GPUs
+const (
+	kdfTime    = 1
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+	kdfKeyLen  = 32 // AES-256
+	kdfSaltLen = 16
+
+	vaultPageSize = 5               // Number of entries on one page of /vault
+	vaultSaveTTL  = 5 * time.Minute // How long the passphrase waits for the password after "Save" click
+	vaultTimeFmt  = "02 Jan 2006 15:04"
+	vaultNoteMax  = 200 // Maximal length of the note in characters
+)
+
+var (
+	ErrWrongEncPass       = errors.New("Wrong encryption password")
+	ErrVaultEntryNotFound = errors.New("Vault entry not found")
+	ErrNothingToSave      = errors.New("There is no passphrase waiting to be saved")
+	ErrNoteTooLong        = errors.New("Note is too long")
+)
+
+// VaultEntry is the encrypted passphrase as it is stored in the database.
+// Only the creation time is kept in plain text, so the vault can be listed
+// without the encryption password
+type VaultEntry struct {
+	ID      int64     `json:"id"`
+	Created time.Time `json:"created"`
+	Sealed  []byte    `json:"sealed"` // nonce followed by AES-GCM ciphertext
+}
+
+// VaultItem is the decrypted content of the vault entry
+type VaultItem struct {
+	Passphrase string `json:"passphrase"`
+	Note       string `json:"note,omitempty"` // Site, account or purpose of the passphrase
+}
+
+// deriveKey derives the encryption key from the user's password and salt
+func deriveKey(password string, salt []byte) []byte {
+	return argon2.IDKey([]byte(password), salt, kdfTime, kdfMemory, kdfThreads, kdfKeyLen)
+}
+
+// newSalt returns a new random salt for the key derivation function
+func newSalt() ([]byte, error) {
+	salt := make([]byte, kdfSaltLen)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// entryAD returns additional data that binds the ciphertext
+// to the owner and to the ID of the entry, so entries can't be
+// swapped between users or positions in the database
+func entryAD(personID int64, entryID int64) []byte {
+	return []byte(fmt.Sprintf("vault:%d:%d", personID, entryID))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with the key. Random nonce is prepended to the result
+func seal(key, plaintext, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// open decrypts data previously encrypted with seal.
+// ErrWrongEncPass is returned if the key doesn't match
+func open(key, sealed, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Sealed data is too short")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrWrongEncPass
+	}
+	return plaintext, nil
+}
+
+// Seal encrypts the item for the entry of the person
+func (e *VaultEntry) Seal(key []byte, personID int64, item VaultItem) error {
+	plaintext, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	e.Sealed, err = seal(key, plaintext, entryAD(personID, e.ID))
+	return err
+}
+
+// Open decrypts the item stored in the entry of the person
+func (e VaultEntry) Open(key []byte, personID int64) (item VaultItem, err error) {
+	plaintext, err := open(key, e.Sealed, entryAD(personID, e.ID))
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(plaintext, &item)
+	return
+}
+
+// pendingSaves keeps passphrases that wait for the encryption password
+// after the user clicked "Save"
+var pendingSaves = newPendingStore[VaultItem](vaultSaveTTL)
+
+// vaultKey checks the password of the person against
+// the stored verifier and derives the vault key from it
+func vaultKey(conn RedisConn, personID int64, password string) ([]byte, error) {
+	rg := conn.NewRedisGetRequest().ID(personID)
+	verifier, err := rg.GetEncVerifier()
+	if err != nil {
+		return nil, err
+	}
+	if len(verifier) == 0 {
+		return nil, ErrEncryptionDisabled
+	}
+	if !checkVerifier(verifier, password) {
+		return nil, ErrWrongEncPass
+	}
+
+	salt, err := rg.GetVaultSalt()
+	if err != nil {
+		return nil, err
+	}
+
+	return deriveKey(password, salt), nil
+}
+
+// savePassword remembers the passphrase from the message
+// and asks the user for the encryption password
+func savePassword(ctx context.Context, cq *tgbotapi.CallbackQuery) error {
+	return startSave(ctx, cq, laVaultSave, "Send me your encryption password to save the passphrase. The message with the password will be deleted immediately.")
+}
+
+// savePasswordNote remembers the passphrase from the message
+// and asks the user for the note that will be saved with it
+func savePasswordNote(ctx context.Context, cq *tgbotapi.CallbackQuery) error {
+	return startSave(ctx, cq, laVaultNote, fmt.Sprintf("Send me a note for the passphrase: site, account or purpose. It will be encrypted together with the passphrase. The note has to be less than %d characters long.", vaultNoteMax))
+}
+
+// messagePassphrase returns the passphrase from the message.
+// It's the code entity, the rest of the text is the strength readout.
+// Offsets of entities are counted in UTF-16 code units
+func messagePassphrase(m *tgbotapi.Message) string {
+	if codes := messageCodes(m); len(codes) > 0 {
+		return codes[0]
+	}
+	// Messages sent before the readout contain only the passphrase
+	return m.Text
+}
+
+// messageCodes returns text of every code entity of the message
+func messageCodes(m *tgbotapi.Message) []string {
+	var codes []string
+	text := utf16.Encode([]rune(m.Text))
+	for _, e := range m.Entities {
+		if e.IsCode() && e.Offset >= 0 && e.Length > 0 && e.Offset+e.Length <= len(text) {
+			codes = append(codes, string(utf16.Decode(text[e.Offset:e.Offset+e.Length])))
+		}
+	}
+	return codes
+}
+
+// startSave remembers the passphrase from the message,
+// sets the last action and sends the prompt to the user
+func startSave(ctx context.Context, cq *tgbotapi.CallbackQuery, la LastAction, prompt string) error {
+	if cq.Message == nil || cq.Message.Text == "" {
+		return ErrNothingToSave
+	}
+
+	conn, ok := ctx.Value("redis-conn").(RedisConn)
+	if !ok {
+		return ErrCantParseCtx
+	}
+
+	enabled, err := encryptionEnabled(conn, cq.From.ID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		callbackAnswer(cq.ID, "Set the encryption password with /encryption first")
+		return nil
+	}
+
+	pendingSaves.Put(cq.From.ID, VaultItem{Passphrase: messagePassphrase(cq.Message)})
+
+	// No need to ask for the password while the vault is unlocked
+	if key, ok := sessionKey(conn, cq.From.ID); ok && la == laVaultSave {
+		msg, err := vaultSave(conn, cq.From.ID, key)
+		botSend(msg)
+		callbackAnswer(cq.ID, "Saved")
+		return err
+	}
+
+	err = setLastAction(ctx, la)
+	if err != nil {
+		return err
+	}
+
+	msg := tgbotapi.NewMessage(cq.From.ID, prompt)
+	msg.ReplyMarkup = IKBCancelAction
+	botSend(msg)
+	callbackAnswer(cq.ID, "Waiting for your message")
+	return nil
+}
+
+// handleVaultNote attaches the note to the passphrase that waits to be saved.
+// If the vault is unlocked, the passphrase is saved at once and saved is true
+func handleVaultNote(conn RedisConn, personID int64, note string) (msg tgbotapi.MessageConfig, saved bool, err error) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	note = strings.TrimSpace(note)
+	if utf8.RuneCountInString(note) > vaultNoteMax {
+		msg.Text = fmt.Sprintf("The note has to be less than %d characters long. Try again.", vaultNoteMax)
+		msg.ReplyMarkup = IKBCancelAction
+		return msg, false, ErrNoteTooLong
+	}
+
+	item, ok := pendingSaves.Take(personID)
+	if !ok {
+		msg.Text = "The passphrase to save has expired. Click \"🖊️ Save with note\" again."
+		return msg, false, ErrNothingToSave
+	}
+	item.Note = note
+	pendingSaves.Put(personID, item)
+
+	if key, ok := sessionKey(conn, personID); ok {
+		msg, err = vaultSave(conn, personID, key)
+		return msg, true, err
+	}
+
+	msg.Text = "Now send me your encryption password to save the passphrase. The message with the password will be deleted immediately."
+	msg.ReplyMarkup = IKBCancelAction
+	return msg, false, nil
+}
+
+// storeVaultItem encrypts the item and adds it to the vault of the person
+func storeVaultItem(conn RedisConn, personID int64, key []byte, item VaultItem) (int64, error) {
+	id, err := conn.NewRedisSetRequest().NextVaultID(personID)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := VaultEntry{ID: id, Created: time.Now()}
+	if err := entry.Seal(key, personID, item); err != nil {
+		return 0, err
+	}
+
+	return id, conn.NewRedisSetRequest().SetVaultEntry(personID, entry)
+}
+
+// vaultKeyErrorText returns the text and keyboard that explain to the user
+// why it's impossible to get the vault key
+func vaultKeyErrorText(err error) (string, interface{}) {
+	switch {
+	case errors.Is(err, ErrWrongEncPass):
+		return "Wrong encryption password. Try again.", IKBCancelAction
+	case errors.Is(err, ErrEncryptionDisabled):
+		return "Set the encryption password with /encryption first.", nil
+	}
+	return "Error on the server side. Sorry.", nil
+}
+
+// handleVaultPassword checks the password sent for one of the vault
+// last actions and finishes the action with the derived key
+func handleVaultPassword(conn RedisConn, personID int64, la LastAction, arg string, password string) (msg tgbotapi.MessageConfig, err error) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	key, err := vaultKey(conn, personID, password)
+	if err != nil {
+		msg.Text, msg.ReplyMarkup = vaultKeyErrorText(err)
+		return msg, err
+	}
+
+	switch la {
+	case laVaultSave:
+		return vaultSave(conn, personID, key)
+
+	case laVaultReveal:
+		entryID, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			msg.Text = "Choose the passphrase to reveal in /vault again."
+			return msg, err
+		}
+		return vaultReveal(conn, personID, key, entryID)
+
+	case laVaultSearch:
+		query, ok := pendingSearches.Take(personID)
+		if !ok {
+			msg.Text = "The search has expired. Type /search again."
+			return msg, ErrNoPendingSearch
+		}
+		return vaultSearch(conn, personID, key, query)
+
+	case laVaultUnlock:
+		return vaultUnlock(conn, personID, key)
+	}
+
+	return msg, nil
+}
+
+// vaultSave saves the passphrase that waits to be saved
+func vaultSave(conn RedisConn, personID int64, key []byte) (msg tgbotapi.MessageConfig, err error) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	item, ok := pendingSaves.Take(personID)
+	if !ok {
+		msg.Text = "The passphrase to save has expired. Click \"💾 Save\" again."
+		return msg, ErrNothingToSave
+	}
+
+	id, err := storeVaultItem(conn, personID, key, item)
+	if err != nil {
+		msg.Text = "Can't save the passphrase. Sorry."
+		return msg, err
+	}
+
+	msg.Text = fmt.Sprintf("Passphrase #%d was encrypted and saved. Type /vault to see your saved passphrases.", id)
+	return msg, nil
+}
+
+// vaultReveal decrypts the entry chosen in /vault
+func vaultReveal(conn RedisConn, personID int64, key []byte, entryID int64) (msg tgbotapi.MessageConfig, err error) {
+	msg = tgbotapi.NewMessage(personID, "")
+
+	entry, err := conn.NewRedisGetRequest().ID(personID).GetVaultEntry(entryID)
+	if err != nil {
+		msg.Text = fmt.Sprintf("Passphrase #%d is not in your vault anymore.", entryID)
+		return msg, err
+	}
+
+	item, err := entry.Open(key, personID)
+	if err != nil {
+		msg.Text = "Can't decrypt the passphrase. Sorry."
+		return msg, err
+	}
+
+	msg.Text = formatVaultItem(entry, item)
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.ReplyMarkup = inlDeleteOnly()
+	return msg, nil
+}
+
+// formatVaultItem returns HTML representation of the decrypted entry
+func formatVaultItem(entry VaultEntry, item VaultItem) string {
+	text := fmt.Sprintf("<b>#%d</b> saved %s", entry.ID, entry.Created.Format(vaultTimeFmt))
+	if item.Note != "" {
+		text += "\n" + tgbotapi.EscapeText(tgbotapi.ModeHTML, item.Note)
+	}
+	return text + fmt.Sprintf("\n<code>%s</code>", tgbotapi.EscapeText(tgbotapi.ModeHTML, item.Passphrase))
+}
+
+// vaultPage returns text and keyboard of the page of /vault
+func vaultPage(conn RedisConn, personID int64, page int) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	entries, err := conn.NewRedisGetRequest().ID(personID).GetVaultEntries()
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, err
+	}
+
+	closeRow := tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Close", "system$$cancel"))
+	if len(entries) == 0 {
+		return "Your vault is empty. Click \"💾 Save\" under a generated passphrase to store it here.", tgbotapi.NewInlineKeyboardMarkup(closeRow), nil
+	}
+
+	pages := (len(entries) + vaultPageSize - 1) / vaultPageSize
+	if page < 0 {
+		page = 0
+	}
+	if page >= pages {
+		page = pages - 1
+	}
+
+	text := fmt.Sprintf("<b>Your vault</b> (page %d of %d)\n\nPassphrases are encrypted. Choose one to reveal it with your encryption password.\n", page+1, pages)
+	end := (page + 1) * vaultPageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	var ikb [][]tgbotapi.InlineKeyboardButton
+	for _, e := range entries[page*vaultPageSize : end] {
+		text += fmt.Sprintf("\n<b>#%d</b> saved %s", e.ID, e.Created.Format(vaultTimeFmt))
+		ikb = append(ikb, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("👁️ #%d", e.ID), fmt.Sprintf("vreveal$$%d", e.ID)),
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("🗑️ #%d", e.ID), fmt.Sprintf("vdel$$%d", e.ID)),
+		))
+	}
+
+	var nav []tgbotapi.InlineKeyboardButton
+	if page > 0 {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("⬅️", fmt.Sprintf("vpage$$%d", page-1)))
+	}
+	if page+1 < pages {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("➡️", fmt.Sprintf("vpage$$%d", page+1)))
+	}
+	if len(nav) > 0 {
+		ikb = append(ikb, nav)
+	}
+	ikb = append(ikb, closeRow)
+
+	return text, tgbotapi.InlineKeyboardMarkup{InlineKeyboard: ikb}, nil
+}
+
+// handleVaultCallback handles clicks on the buttons of the /vault message
+func handleVaultCallback(ctx context.Context, cq *tgbotapi.CallbackQuery, action string, arg string) error {
+	conn, ok := ctx.Value("redis-conn").(RedisConn)
+	if !ok {
+		return ErrCantParseCtx
+	}
+
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "vpage":
+		return editVaultPage(conn, cq, int(n))
+
+	case "vreveal":
+		if key, ok := sessionKey(conn, cq.From.ID); ok {
+			msg, err := vaultReveal(conn, cq.From.ID, key, n)
+			botSend(msg)
+			callbackAnswer(cq.ID, "")
+			return err
+		}
+		if err := setLastAction(ctx, laVaultReveal); err != nil {
+			return err
+		}
+		if err := setLastActionArg(ctx, arg); err != nil {
+			return err
+		}
+		msg := tgbotapi.NewMessage(cq.From.ID, fmt.Sprintf("Send me your encryption password to reveal passphrase #%d. The message with the password will be deleted immediately.", n))
+		msg.ReplyMarkup = IKBCancelAction
+		botSend(msg)
+		callbackAnswer(cq.ID, "Waiting for the encryption password")
+
+	case "vdel":
+		err := conn.NewRedisDelRequest().ID(cq.From.ID).DeleteVaultEntry(n)
+		if err != nil {
+			callbackAnswer(cq.ID, "Can't delete the passphrase")
+			return err
+		}
+		callbackAnswer(cq.ID, fmt.Sprintf("Passphrase #%d deleted", n))
+		logger.Info("Deleted vault entry", zap.Int64("personid", cq.From.ID), zap.Int64("entry", n))
+		return editVaultPage(conn, cq, 0)
+	}
+
+	return nil
+}
+
+// editVaultPage replaces the /vault message with the given page
+func editVaultPage(conn RedisConn, cq *tgbotapi.CallbackQuery, page int) error {
+	text, ikb, err := vaultPage(conn, cq.From.ID, page)
+	if err != nil {
+		return err
+	}
+
+	ec := tgbotapi.NewEditMessageTextAndMarkup(cq.Message.Chat.ID, cq.Message.MessageID, text, ikb)
+	ec.ParseMode = tgbotapi.ModeHTML
+	_, err = bot.Request(ec)
+	return err
+}
+
+// sortVaultEntries sorts entries from the newest to the oldest
+func sortVaultEntries(entries []VaultEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID > entries[j].ID
+	})
+}
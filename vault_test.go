@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, kdfKeyLen)
+}
+
+func TestVaultEntrySealOpen(t *testing.T) {
+	key := testKey(1)
+	item := VaultItem{Passphrase: "correct horse battery staple", Note: "mail"}
+
+	e := VaultEntry{ID: 7}
+	if err := e.Seal(key, 42, item); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(e.Sealed, []byte(item.Passphrase)) {
+		t.Fatal("passphrase is stored in plain text")
+	}
+	if got, err := e.Open(key, 42); err != nil || got != item {
+		t.Fatalf("got %+v, %v, want %+v", got, err, item)
+	}
+
+	// Sealing the same item again gives another ciphertext
+	again := VaultEntry{ID: 7}
+	if err := again.Seal(key, 42, item); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again.Sealed, e.Sealed) {
+		t.Error("nonce is reused")
+	}
+
+	tests := []struct {
+		name     string
+		key      []byte
+		personID int64
+		entryID  int64
+	}{
+		{"wrong key", testKey(2), 42, 7},
+		{"another person", key, 43, 7},
+		{"another entry", key, 42, 8},
+	}
+	for _, tt := range tests {
+		moved := VaultEntry{ID: tt.entryID, Sealed: e.Sealed}
+		if _, err := moved.Open(tt.key, tt.personID); !errors.Is(err, ErrWrongEncPass) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, ErrWrongEncPass)
+		}
+	}
+}
+
+func TestEntryAD(t *testing.T) {
+	if got := string(entryAD(42, 7)); got != "vault:42:7" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	key := testKey(1)
+	ad := entryAD(1, 1)
+	sealed, err := seal(key, []byte("secret"), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := open(key, sealed, ad); !errors.Is(err, ErrWrongEncPass) {
+		t.Errorf("got %v for changed ciphertext", err)
+	}
+	if _, err := open(key, sealed[:4], ad); err == nil {
+		t.Error("short data is opened")
+	}
+}
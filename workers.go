@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/gomodule/redigo/redis"
+	"go.uber.org/zap"
+)
+
+const (
+	defWorkers      = 8                // Default number of workers
+	workerQueue     = 64               // Number of updates waiting for every worker
+	shutdownTimeout = 10 * time.Second // Time to finish updates that are already taken
+	updateTimeout   = time.Minute      // Time of one update, its storage calls are cancelled after it
+)
+
+// workersCount returns number of workers.
+// It can be changed with PASSPHRASEBOT_WORKERS environment variable
+func workersCount() int {
+	if n, err := strconv.Atoi(os.Getenv("PASSPHRASEBOT_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return defWorkers
+}
+
+// workerPool handles updates of different people in parallel. All updates
+// of one person go to the same worker, so they are handled in order
+type workerPool struct {
+	queues []chan tgbotapi.Update
+	wg     sync.WaitGroup
+	cancel context.CancelFunc // Cancels updates that are still handled when the time of Stop is over
+}
+
+// startWorkers starts n workers. One connection isn't safe for goroutines,
+// so every update gets its own connection from the pool. A connection
+// that has run out of time is broken, so it isn't kept for the next update
+func startWorkers(n int, pool *redis.Pool, newStorage StorageFunc, router *Router) *workerPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	wp := &workerPool{queues: make([]chan tgbotapi.Update, n), cancel: cancel}
+	for i := range wp.queues {
+		q := make(chan tgbotapi.Update, workerQueue)
+		wp.queues[i] = q
+
+		wp.wg.Add(1)
+		go func() {
+			defer wp.wg.Done()
+			for upd := range q {
+				handleUpdate(ctx, pool, newStorage, router, upd)
+			}
+		}()
+	}
+	logger.Info("Started workers", zap.Int("workers", n))
+	return wp
+}
+
+// handleUpdate passes the update to the router with the connection whose
+// operations are cancelled with the context of the update.
+// Without Redis the pool is nil and only the vault fails
+func handleUpdate(ctx context.Context, pool *redis.Pool, newStorage StorageFunc, router *Router, upd tgbotapi.Update) {
+	ctx, cancel := context.WithTimeout(ctx, updateTimeout)
+	defer cancel()
+
+	conn := NewConn(pool)
+	defer conn.Close()
+	conn = conn.WithContext(ctx)
+
+	ctx = context.WithValue(ctx, "redis-conn", conn)
+	ctx = context.WithValue(ctx, "storage", newStorage(conn))
+	router.Handle(ctx, upd)
+}
+
+// updateKey returns ID of the person or the chat the update belongs to
+func updateKey(upd tgbotapi.Update) int64 {
+	if from := upd.SentFrom(); from != nil {
+		return from.ID
+	}
+	if chat := upd.FromChat(); chat != nil {
+		return chat.ID
+	}
+	return 0
+}
+
+// Dispatch passes the update to the worker of its person.
+// It waits if the worker has too many updates
+func (wp *workerPool) Dispatch(upd tgbotapi.Update) {
+	i := uint64(updateKey(upd)) % uint64(len(wp.queues))
+	wp.queues[i] <- upd
+}
+
+// Stop lets workers finish the updates they have and waits for them
+// at most timeout. false is returned if they didn't finish in time
+func (wp *workerPool) Stop(timeout time.Duration) bool {
+	for _, q := range wp.queues {
+		close(q)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wp.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		// Updates waiting for Redis fail at once
+		wp.cancel()
+		return false
+	}
+}